@@ -4,35 +4,56 @@ import (
 	"context"
 	"crypto/x509"
 	"flag"
-	"log"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/gcp"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
-	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/sts"
-	"github.com/costinm/ugate/pkg/auth"
-	"google.golang.org/grpc"
-
 	"github.com/costinm/hbone"
-	"github.com/costinm/krun/third_party/istio/cas"
-	"github.com/costinm/krun/third_party/istio/istioca"
-	"github.com/costinm/krun/third_party/istio/meshca"
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/certs"
+	"github.com/costinm/krun/pkg/logs"
 )
 
 var (
 	ns       = flag.String("n", "fortio", "Namespace")
 	aud      = flag.String("audience", "", "Audience to use in the CSR request")
-	provider = flag.String("addr", "meshca", "Address. If empty will use the cluster default. meshca or cas can be used as shortcut")
+	provider = flag.String("addr", "meshca", "Address. If empty will use the cluster default. meshca, cas, istiod, vault or local can be used as shortcut, or provider://target. A comma separated list is tried in order")
+	ttl      = flag.Duration("ttl", 24*time.Hour, "Requested certificate lifetime")
+	keyType  = flag.String("key-type", ca.KeyRSA2048, "Workload key type: rsa-2048, rsa-4096, ecdsa-p256, ecdsa-p384 or ed25519")
+
+	outDir        = flag.String("out", "", "Directory where the certificates are saved. Default depends on the format")
+	format        = flag.String("format", "workload", "Comma separated output formats: workload, istio, spiffe, k8s, pkcs12")
+	secretName    = flag.String("secret-name", "workload-certs", "Name of the Secret, for the k8s format")
+	caTimeout     = flag.Duration("ca-timeout", 10*time.Second, "Timeout for each call to the CA")
+	caAttempts    = flag.Int("ca-attempts", 5, "Max attempts for each CA, retrying on Unavailable, DeadlineExceeded, ResourceExhausted, Aborted")
+	trust         = flag.String("trust", "", "Comma separated list of additional CA addresses to fetch the published trust roots from (CAS, Vault), for root rotation or CA migration")
+	watch         = flag.Bool("watch", false, "Keep running, renewing the certificate before it expires")
+	renewFraction = flag.Float64("renew", 0.5, "Fraction of the certificate lifetime after which it is renewed, in watch mode")
+	statusFile    = flag.String("status", "", "File where the next renewal time is saved, in watch mode")
+	kek           = flag.String("kek", os.Getenv("KEY_ENCRYPTION_KEY"), "File with the key-encryption-key, or localkms:///DIR. If set, the private key is saved encrypted")
+	provCert      = flag.String("prov-cert", os.Getenv("PROV_CERT"), "Directory with a provisioning cert (cert-chain.pem, key.pem, root-cert.pem), used to authenticate to Istiod with mTLS if no K8S or GCP token source is found")
 )
 
+var logger = logs.New("certtool")
+
 // CLI to get the mesh certificates, using MeshCA, CAS os Istio CA.
 // The resulting certificate is saved using workload certificate paths.
 //
-// This should be run periodically to refresh the certs in environments where
-// CSI or other native integration is missing.
+// With -watch, the same key is re-signed periodically - for environments where
+// CSI or other native integration is missing. Otherwise it should be run periodically
+// to refresh the certs.
+//
+// 'certtool inspect' checks existing certificates, without connecting to the CA.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		inspectMain(os.Args[2:])
+		return
+	}
 	flag.Parse()
+	logs.StdLog(logger)
 	//startCtx := context.Background()
 
 	kr := mesh.New()
@@ -41,13 +62,36 @@ func main() {
 	}
 	ctx := context.Background()
 
-	err := gcp.InitGCP(ctx, kr)
+	kp, err := ca.NewKeyProtector(*kek)
 	if err != nil {
-		log.Fatal("Failed to find K8S ", time.Since(kr.StartTime), kr, os.Environ(), err)
+		logger.Fatal("Failed to load key-encryption-key", "error", err)
 	}
-	err = kr.LoadConfig(context.Background())
-	if err != nil {
-		log.Fatal("Failed to connect to mesh ", time.Since(kr.StartTime), kr, os.Environ(), err)
+
+	// The local CA works without GCP or a cluster - for development and tests. Vault with a
+	// token doesn't need GCP or K8S either.
+	offline := *provider == "local" || strings.HasPrefix(*provider, "local://") ||
+		(os.Getenv("VAULT_TOKEN") != "" && (*provider == "vault" || strings.HasPrefix(*provider, "vault://")))
+	// With a provisioning cert and no token source, the identity and roots come from the cert.
+	var pc *certs.ProvCert
+	if offline {
+		if kr.KSA == "" {
+			kr.KSA = "default"
+		}
+		if kr.TrustDomain == "" {
+			kr.TrustDomain = "cluster.local"
+		}
+	} else {
+		err := gcp.InitGCP(ctx, kr)
+		if err == nil {
+			err = kr.LoadConfig(context.Background())
+		}
+		if err != nil && *provCert != "" {
+			logger.Info("No K8S or GCP token source, using provisioning cert", "dir", *provCert, "error", err)
+			pc = loadProvCert(kr, *provCert, kp)
+		} else if err != nil {
+			logger.Fatal("Failed to connect to mesh", "elapsed", time.Since(kr.StartTime), "project", kr.ProjectId,
+				"location", kr.ClusterLocation, "cluster", kr.ClusterName, "namespace", kr.Namespace, "error", err)
+		}
 	}
 
 	//k8s := &k8s.K8S{Mesh: kr}
@@ -64,136 +108,193 @@ func main() {
 	// Need the settings from mesh-env
 	//f, err := initOTel(startCtx, kr)
 	//if err != nil {
-	//	log.Println("OTel init failed", err)
+	//	logger.Warn("OTel init failed", "error", err)
 	//} else {
 	//	defer f()
 	//}
 
-	if kr.MeshConnectorAddr == "" {
-		log.Fatal("Failed to find in-cluster, missing 'hgate' service in mesh env")
+	if !offline && pc == nil {
+		if kr.MeshConnectorAddr == "" {
+			logger.Fatal("Failed to find in-cluster, missing 'hgate' service in mesh env")
+		}
+		kr.XDSAddr = kr.MeshConnectorAddr + ":15012"
 	}
 
-	kr.XDSAddr = kr.MeshConnectorAddr + ":15012"
-
 	// Used to generate the CSR
-	a := auth.NewCertAuth()
-	priv, csr, err := a.NewCSR("rsa", kr.TrustDomain, "spiffe://"+kr.TrustDomain+"/ns/"+kr.Namespace+"/sa/"+kr.KSA)
+	priv, csr, err := ca.NewCSR(*keyType, kr.TrustDomain, ca.SpiffeID(kr))
 	if err != nil {
-		log.Fatal("Failed to find mesh certificates ", err)
+		logger.Fatal("Failed to generate CSR", "error", err)
 	}
 
-	// TODO: fetch public keys too - possibly from all
+	// Roots from all the configured CAs are trusted: the Istiod root from mesh-env, the roots
+	// published by the CAs, the self-signed tail of the chains returned by the CA.
+	bundle := &certs.TrustBundle{}
+	if kr.CitadelRoot != "" {
+		if err := bundle.Add("istiod", kr.CitadelRoot); err != nil {
+			logger.Warn("Invalid Istiod root in mesh-env", "error", err)
+		}
+	}
 
-	if *provider == "meshca" {
-		InitMeshCA(kr, auth, csr, priv)
-	} else if *provider == "cas" {
-		InitCAS(kr, auth, csr, priv)
-	} else {
-		InitMeshCert(kr, auth, csr, priv)
+	caOpts := &ca.Options{
+		GRPCOptions:  OTELGRPCClient(),
+		Retry:        &ca.RetryPolicy{Timeout: *caTimeout, MaxAttempts: *caAttempts},
+		KeyProtector: kp,
 	}
-	cert, err := x509.ParseCertificate(auth.Cert.Certificate[0])
+	if pc != nil {
+		caOpts.ProvCert = pc.Dir
+		caOpts.TrustedRoots = pc.Roots
+		if pc.RootsPEM != "" {
+			if err := bundle.Add("prov-cert", pc.RootsPEM); err != nil {
+				logger.Warn("Invalid provisioning cert roots", "error", err)
+			}
+		}
+	}
+	signer, err := ca.New(ctx, kr, *provider, caOpts)
 	if err != nil {
-		panic(err)
+		logger.Fatal("Failed to create CA client", "addr", *provider, "error", err)
 	}
-
-	log.Println(cert.URIs, cert.Subject)
-	time.Sleep(4 * time.Second)
-}
-
-func InitMeshCert(kr *mesh.KRun, auth *hbone.Auth, csr []byte, priv []byte) {
-	if kr.CitadelRoot != "" && kr.MeshConnectorAddr != "" {
-		auth.AddRoots([]byte(kr.CitadelRoot))
-
-		grpccreds, _ := sts.NewSTS(&sts.AuthConfig{
-			ProjectNumber:  kr.ProjectNumber,
-			TrustDomain:    kr.TrustDomain,
-			ClusterAddress: kr.ClusterAddress,
-			TokenSource:    kr,
-		})
-		// Audience: "istio-ca"
-		cca, err := istioca.NewCitadelClient(&istioca.Options{
-			TokenProvider: grpccreds,
-			CAEndpoint:    kr.MeshConnectorAddr + ":15012",
-			TrustedRoots:  auth.TrustedCertPool,
-			CAEndpointSAN: "istiod.istio-system.svc",
-			GRPCOptions:   OTELGRPCClient(),
-		})
+	fetchRoots(ctx, bundle, *provider, signer)
+	for _, addr := range strings.Split(*trust, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		s, err := ca.New(ctx, kr, addr, caOpts)
 		if err != nil {
-			log.Fatal(err)
+			logger.Warn("Failed to create CA client for trust roots", "addr", addr, "error", err)
+			continue
 		}
-		chain, err := cca.CSRSign(csr, 24*3600)
+		fetchRoots(ctx, bundle, addr, s)
+	}
+	auth := &hbone.Auth{TrustedCertPool: bundle.Pool()}
+
+	// The password is read from the env, to keep it out of the process list.
+	wopts := &certs.WriterOptions{
+		Dir:          *outDir,
+		Name:         *secretName,
+		Namespace:    kr.Namespace,
+		Password:     os.Getenv("PKCS12_PASSWORD"),
+		KeyProtector: kp,
+	}
+	save, err := certs.NewWriter(*format, wopts)
+	if err != nil {
+		logger.Fatal("Invalid output format", "format", *format, "error", err)
+	}
 
-		//log.Println(chain, err)
-		err = auth.SetKeysPEM(priv, chain)
-		if err != nil {
-			log.Fatal(err)
+	r := &certs.Renewer{
+		Signer:        signer,
+		PrivPEM:       priv,
+		CSR:           csr,
+		TTL:           *ttl,
+		RenewFraction: *renewFraction,
+		OnCert: func(priv []byte, chain []string) error {
+			// The tail of the chain is trusted only if it is a root - otherwise the roots published
+			// by the CA are used.
+			if tail := chain[len(chain)-1]; certs.IsSelfSigned(tail) {
+				if err := bundle.Add(signedBy(signer), tail); err != nil {
+					return err
+				}
+			} else {
+				fetchRoots(ctx, bundle, *provider, signer)
+			}
+			if bundle.Len() == 0 {
+				return fmt.Errorf("no trust roots for the chain signed by %s", signedBy(signer))
+			}
+			err := auth.SetKeysPEM(priv, chain)
+			if err != nil {
+				return err
+			}
+			auth.TrustedCertPool = bundle.Pool()
+			roots := bundle.PEM()
+			err = save(priv, chain, roots)
+			if err != nil {
+				return err
+			}
+			// The provenance of the roots is saved next to the cert.
+			return bundle.Save(wopts.DirFor(strings.Split(*format, ",")[0]))
+		},
+	}
+
+	next, err := r.Renew(ctx)
+	if err != nil {
+		if !*watch {
+			logger.Fatal("Failed to sign", "addr", *provider, "error", err)
 		}
+		logger.Warn("Failed to sign", "retry", next, "addr", *provider, "error", err)
 	} else {
-		InitMeshCA(kr, auth, csr, priv)
+		cert, err := x509.ParseCertificate(auth.Cert.Certificate[0])
+		if err != nil {
+			panic(err)
+		}
+		logger.Info("Certificate saved", "uris", cert.URIs, "subject", cert.Subject, "notAfter", cert.NotAfter,
+			"keyType", ca.KeyType(cert.PublicKey), "ca", signedBy(signer))
 	}
-}
 
-func InitMeshCA(kr *mesh.KRun, auth *hbone.Auth, csr []byte, priv []byte) {
-	tokenProvider, err := sts.NewSTS(&sts.AuthConfig{
-		ProjectNumber:  kr.ProjectNumber,
-		TrustDomain:    kr.TrustDomain,
-		ClusterAddress: kr.ClusterAddress,
-		TokenSource:    kr,
-	})
-	tokenProvider.UseAccessToken = false // even if audience is provided.
+	if !*watch {
+		time.Sleep(4 * time.Second)
+		return
+	}
 
-	// TODO: Use MeshCA if citadel is not in cluster
-	var ol []grpc.DialOption
-	ol = append(ol, grpc.WithPerRPCCredentials(tokenProvider))
-	ol = append(ol, OTELGRPCClient()...)
+	for {
+		next = r.NextRenewal()
+		logger.Info("Next certificate renewal", "nextRenewal", next)
+		if *statusFile != "" {
+			err = certs.WriteFile(*statusFile, []byte(next.Format(time.RFC3339)+"\n"), 0644)
+			if err != nil {
+				logger.Warn("Failed to save status", "error", err)
+			}
+		}
+		time.Sleep(time.Until(next))
 
-	mca, err := meshca.NewGoogleCAClient("meshca.googleapis.com:443",
-		ol)
-	chain, err := mca.CSRSign(csr, 1*3600)
+		_, err = r.Renew(ctx)
+		if err != nil {
+			logger.Warn("Certificate renewal failed", "addr", *provider, "error", err)
+		}
+	}
+}
 
-	if err != nil {
-		log.Fatal(err)
+// fetchRoots adds the roots published by the CA to the bundle. CAs without an API to get the
+// roots only contribute the root at the end of the chains they sign.
+func fetchRoots(ctx context.Context, bundle *certs.TrustBundle, addr string, s ca.Signer) {
+	rp, ok := s.(ca.RootProvider)
+	if !ok {
+		logger.Info("CA doesn't publish trust roots", "addr", addr)
+		return
 	}
-	//log.Println(chain, priv)
-	err = auth.SetKeysPEM(priv, chain)
+	roots, err := rp.GetRootCertBundle(ctx)
 	if err != nil {
-		log.Fatal(err)
+		logger.Warn("Failed to fetch roots", "addr", addr, "error", err)
+		return
+	}
+	for _, r := range roots {
+		if err := bundle.Add(addr, r); err != nil {
+			logger.Warn("Invalid root", "addr", addr, "error", err)
+		}
 	}
-
 }
 
-// TODO
-func InitCAS(kr *mesh.KRun, auth *hbone.Auth, csr []byte, priv []byte) {
-	// TODO: Use MeshCA if citadel is not in cluster
-	tokenProvider, err := sts.NewSTS(&sts.AuthConfig{
-		ProjectNumber:  kr.ProjectNumber,
-		TrustDomain:    kr.TrustDomain,
-		ClusterAddress: kr.ClusterAddress,
-		TokenSource:    kr,
-	})
-
-	// This doesn't work
-	//  Could not use the REFLECTED_SPIFFE subject mode because the caller does not have a SPIFFE identity. Please visit the CA Service documentation to ensure that this is a supported use-case
-	//  tokenProvider.MDPSA = true
-	// The token MUST be the federated access token
-
-	tokenProvider.UseAccessToken = true // even if audience is provided.
-
-	var ol []grpc.DialOption
-	ol = append(ol, grpc.WithPerRPCCredentials(tokenProvider))
-	ol = append(ol, OTELGRPCClient()...)
-
-	mca, err := cas.NewGoogleCASClient("projects/"+kr.ProjectId+
-		"/locations/"+kr.Region()+"/caPools/istio", ol)
-	chain, err := mca.CSRSign(csr, 24*3600)
+// signedBy returns the address of the CA that signed the last certificate.
+func signedBy(s ca.Signer) string {
+	if f, ok := s.(*ca.Failover); ok {
+		return f.Last()
+	}
+	return *provider
+}
 
-	if err != nil {
-		log.Fatal(err)
+// loadProvCert loads the provisioning cert and sets the workload identity from it. Only Istiod
+// accepts the provisioning cert, and the address must be explicit - there is no mesh-env.
+func loadProvCert(kr *mesh.KRun, dir string, kp ca.KeyProtector) *certs.ProvCert {
+	name, target := ca.ParseAddr(kr, *provider)
+	if name != "istiod" || target == "" {
+		logger.Fatal("Provisioning cert requires an explicit Istiod address, like -addr istiod://HOST:15012", "addr", *provider)
 	}
-	//log.Println(chain, priv)
-	err = auth.SetKeysPEM(priv, chain)
+	pc, err := certs.LoadProvCert(dir, kp)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Failed to load provisioning cert", "dir", dir, "error", err)
 	}
-
+	if err = pc.SetIdentity(kr); err != nil {
+		logger.Fatal("Invalid provisioning cert identity", "dir", dir, "error", err)
+	}
+	logger.Info("Provisioning cert loaded", "id", pc.SpiffeID, "notAfter", pc.NotAfter)
+	return pc
 }
@@ -14,17 +14,16 @@ replace github.com/GoogleCloudPlatform/cloud-run-mesh => ../../../cloud-run-mesh
 
 require (
 	github.com/costinm/hbone v0.0.0-20211105170253-a27d86dc30cf
-	github.com/costinm/krun/third_party v0.0.0-20220127213137-ae2fe5bcc4b1
+	github.com/costinm/krun/third_party v0.0.0-20220127213137-ae2fe5bcc4b1 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.28.0
 	go.opentelemetry.io/otel v1.3.0
 	go.opentelemetry.io/otel/exporters/stdout/stdoutmetric v0.26.0
 	go.opentelemetry.io/otel/sdk v1.3.0
 	go.opentelemetry.io/otel/sdk/metric v0.26.0
-
 )
 
 require (
-	github.com/costinm/ugate v0.0.0-20220614135442-cafcfb6d0da4
+	github.com/costinm/krun v0.0.0-00010101000000-000000000000
 	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.28.0
 	go.opentelemetry.io/contrib/instrumentation/host v0.27.0
 	go.opentelemetry.io/contrib/instrumentation/runtime v0.27.0
@@ -108,4 +107,5 @@ require (
 	sigs.k8s.io/json v0.0.0-20211208200746-9f7c6b3444d2 // indirect
 	sigs.k8s.io/structured-merge-diff/v4 v4.2.1 // indirect
 	sigs.k8s.io/yaml v1.3.0 // indirect
+	software.sslmate.com/src/go-pkcs12 v0.0.0-20210415151418-c5206de65a78 // indirect
 )
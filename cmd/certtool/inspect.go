@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/certs"
+)
+
+// inspectMain implements 'certtool inspect' - offline checks of the certificates, to debug mTLS failures.
+// Exits with code 1 if problems are found.
+func inspectMain(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	certFile := fs.String("cert", "", "PEM file with the cert chain, workload cert first")
+	rootsFile := fs.String("roots", "", "PEM file with the trusted roots")
+	dir := fs.String("dir", "", "Directory with the key and certificates - workload, istio or spiffe layout. Default is the krun cert dirs, if cert is not set")
+	td := fs.String("trust-domain", "", "Expected trust domain. Default is the mesh trust domain")
+	threshold := fs.Duration("expiry", 6*time.Hour, "Report certificates expiring within this interval")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	kek := fs.String("kek", os.Getenv("KEY_ENCRYPTION_KEY"), "File with the key-encryption-key, or localkms:///DIR, if the private key is encrypted")
+	fs.Parse(args)
+
+	if *td == "" {
+		*td = mesh.New().TrustDomain
+	}
+
+	kp, err := ca.NewKeyProtector(*kek)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid key-encryption-key:", err)
+		os.Exit(2)
+	}
+	chain, roots, err := loadForInspect(*certFile, *rootsFile, *dir, kp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load certificates:", err)
+		os.Exit(2)
+	}
+
+	r := certs.Inspect(chain, &certs.InspectOptions{
+		Roots:           roots,
+		TrustDomain:     *td,
+		ExpiryThreshold: *threshold,
+	})
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		printReport(r, roots != nil)
+	}
+	if len(r.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadForInspect reads the chain and roots from the files, or from the dir. The key in dir is decrypted
+// with kp and checked against the cert.
+func loadForInspect(certFile, rootsFile, dir string, kp ca.KeyProtector) ([]*x509.Certificate, *x509.CertPool, error) {
+	var chainPEM, rootsPEM []byte
+	var err error
+	if certFile != "" {
+		chainPEM, err = ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// Same files and defaults as krun.
+		dirs := []string{dir}
+		if dir == "" {
+			dirs = []string{certs.WorkloadCertDir, certs.IstioCertDir}
+		}
+		for _, d := range dirs {
+			var priv []byte
+			var chain []string
+			var roots string
+			priv, chain, roots, err = certs.LoadCerts(d, kp)
+			if err != nil {
+				continue
+			}
+			chainPEM, rootsPEM = []byte(certs.JoinPEM(chain)), []byte(roots)
+			if _, err = tls.X509KeyPair(chainPEM, priv); err != nil {
+				return nil, nil, fmt.Errorf("invalid private key in %s: %v", d, err)
+			}
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	chain, err := certs.ParseCerts(string(chainPEM))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(chain) == 0 {
+		return nil, nil, errors.New("no certificate found")
+	}
+
+	if rootsFile != "" {
+		rootsPEM, err = ioutil.ReadFile(rootsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(rootsPEM) == 0 {
+		return chain, nil, nil
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, nil, errors.New("no roots found")
+	}
+	return chain, roots, nil
+}
+
+func printReport(r *certs.Report, hasRoots bool) {
+	for i, c := range r.Chain {
+		fmt.Printf("[%d] %s\n", i, c.Subject)
+		fmt.Printf("    issuer:   %s\n", c.Issuer)
+		if len(c.URIs) > 0 {
+			fmt.Printf("    uris:     %s\n", strings.Join(c.URIs, " "))
+		}
+		if c.TrustDomain != "" {
+			fmt.Printf("    identity: trust domain %s, namespace %s, service account %s\n",
+				c.TrustDomain, c.Namespace, c.ServiceAccount)
+		}
+		fmt.Printf("    key:      %s, CA: %v\n", c.KeyType, c.IsCA)
+		fmt.Printf("    valid:    %s - %s\n", c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339))
+	}
+	switch {
+	case !hasRoots:
+		fmt.Println("Chain not verified, no roots")
+	case r.Verified:
+		fmt.Println("Chain verified")
+	}
+	for _, p := range r.Problems {
+		fmt.Println("PROBLEM:", p)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/certs"
+)
+
+func TestLoadForInspectEncrypted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "inspect")
+	defer os.RemoveAll(dir)
+	local, err := ca.NewLocalCA(dir+"/ca", "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, csr, err := ca.NewCSR(ca.KeyECDSAP256, "cluster.local", "spiffe://cluster.local/ns/test/sa/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := local.CSRSign(context.Background(), csr, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, _ := ca.NewLocalKEK(bytes.Repeat([]byte{1}, 32))
+	save, _ := certs.NewWriter("workload", &certs.WriterOptions{Dir: dir, KeyProtector: kp})
+	if err = save(priv, chain, chain[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	c, roots, err := loadForInspect("", "", dir, kp)
+	if err != nil || len(c) != 2 || roots == nil {
+		t.Fatalf("failed to load encrypted dir %d %v", len(c), err)
+	}
+	other, _ := ca.NewLocalKEK(bytes.Repeat([]byte{2}, 32))
+	for name, kp := range map[string]ca.KeyProtector{"no kek": nil, "wrong kek": other} {
+		if _, _, err := loadForInspect("", "", dir, kp); err == nil {
+			t.Errorf("%s: encrypted key loaded", name)
+		}
+	}
+}
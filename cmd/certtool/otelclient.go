@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"os"
 	"time"
@@ -123,7 +122,7 @@ func initOTel(ctx context.Context, kr *mesh.KRun) (func(), error) {
 			stdoutmetric.WithWriter(os.Stderr))
 	}
 	if err != nil {
-		log.Fatalf("creating stdoutmetric exporter: %v", err)
+		logger.Fatal("Failed to create stdoutmetric exporter", "error", err)
 	}
 
 	pusher := controller.New(
@@ -139,7 +138,7 @@ func initOTel(ctx context.Context, kr *mesh.KRun) (func(), error) {
 	)
 
 	if err = pusher.Start(ctx); err != nil {
-		log.Fatalf("starting push controller: %v", err)
+		logger.Fatal("Failed to start push controller", "error", err)
 	}
 
 	global.SetMeterProvider(pusher)
@@ -148,7 +147,7 @@ func initOTel(ctx context.Context, kr *mesh.KRun) (func(), error) {
 	if err := runtime.Start(
 		runtime.WithMinimumReadMemStatsInterval(time.Second),
 	); err != nil {
-		log.Fatalln("failed to start runtime instrumentation:", err)
+		logger.Fatal("Failed to start runtime instrumentation", "error", err)
 	}
 	// Host telemetry -
 	host.Start()
@@ -156,10 +155,10 @@ func initOTel(ctx context.Context, kr *mesh.KRun) (func(), error) {
 	// End telemetry magic
 	return func() {
 		if err := pusher.Stop(ctx); err != nil {
-			log.Fatalf("stopping push controller: %v", err)
+			logger.Fatal("Failed to stop push controller", "error", err)
 		}
 		if err := tp.Shutdown(context.Background()); err != nil {
-			log.Fatal(err)
+			logger.Fatal("Failed to stop tracer provider", "error", err)
 		}
 	}, nil
 	/*
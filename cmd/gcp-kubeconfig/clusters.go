@@ -0,0 +1,231 @@
+//Copyright 2021 Google LLC
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	container "cloud.google.com/go/container/apiv1"
+	gkehub "cloud.google.com/go/gkehub/apiv1beta1"
+	"google.golang.org/api/iterator"
+	gkehubpb "google.golang.org/genproto/googleapis/cloud/gkehub/v1beta1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// connectGatewayURL is the K8S API server for a Hub membership, used for clusters
+// without a reachable GKE endpoint.
+const connectGatewayURL = "https://connectgateway.googleapis.com/v1/projects/%s/locations/%s/gkeMemberships/%s"
+
+// Cluster is a GKE cluster or Hub membership matching the filters.
+type Cluster struct {
+	Project  string
+	Location string
+	Name     string
+
+	// Server is the K8S API server URL - the GKE endpoint or the Connect Gateway.
+	Server string
+
+	// CAData is the PEM CA of the API server. Empty for Connect Gateway, which uses a public cert.
+	CAData []byte
+
+	Labels map[string]string
+
+	// Membership is the full name of the Hub (Fleet) membership, if the cluster is registered.
+	Membership string
+}
+
+// ContextName is the name used by 'gcloud container clusters get-credentials'.
+func (c *Cluster) ContextName() string {
+	return "gke_" + c.Project + "_" + c.Location + "_" + c.Name
+}
+
+// Filter selects the clusters to include.
+type Filter struct {
+	Projects []string
+
+	// Location is a zone or region, "-" or empty for all.
+	Location string
+
+	// Selector is matched against the GKE resource labels, or the membership labels.
+	Selector labels.Selector
+
+	// Fleet restricts the result to clusters registered in the project Hub, and adds
+	// non-GKE memberships using the Connect Gateway.
+	Fleet bool
+}
+
+// FindClusters lists the GKE clusters and Hub memberships in the projects and returns
+// the ones matching the filter, sorted by context name.
+func FindClusters(ctx context.Context, f *Filter) ([]*Cluster, error) {
+	cm, err := container.NewClusterManagerClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cm.Close()
+
+	var hub *gkehub.GkeHubMembershipClient
+	if f.Fleet {
+		hub, err = gkehub.NewGkeHubMembershipClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer hub.Close()
+	}
+
+	loc := f.Location
+	if loc == "" {
+		loc = "-"
+	}
+	res := []*Cluster{}
+	for _, p := range f.Projects {
+		cl, err := cm.ListClusters(ctx, &containerpb.ListClustersRequest{
+			Parent: "projects/" + p + "/locations/" + loc,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing clusters in %s: %v", p, err)
+		}
+		byLink := map[string]*Cluster{}
+		for _, c := range cl.Clusters {
+			ca, err := base64.StdEncoding.DecodeString(c.GetMasterAuth().GetClusterCaCertificate())
+			if err != nil {
+				logger.Warn("Invalid cluster CA", "cluster", c.Name, "error", err)
+				continue
+			}
+			kc := &Cluster{
+				Project:  p,
+				Location: c.Location,
+				Name:     c.Name,
+				Server:   "https://" + c.Endpoint,
+				CAData:   ca,
+				Labels:   c.ResourceLabels,
+			}
+			byLink["//container.googleapis.com/projects/"+p+"/locations/"+c.Location+"/clusters/"+c.Name] = kc
+		}
+
+		if !f.Fleet {
+			for _, c := range byLink {
+				if f.Selector.Matches(labels.Set(c.Labels)) {
+					res = append(res, c)
+				}
+			}
+			continue
+		}
+
+		it := hub.ListMemberships(ctx, &gkehubpb.ListMembershipsRequest{
+			Parent: "projects/" + p + "/locations/-",
+		})
+		for {
+			m, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("listing memberships in %s: %v", p, err)
+			}
+			name := m.Name[strings.LastIndex(m.Name, "/")+1:]
+			mloc := membershipLocation(m.Name)
+			c := byLink[m.GetEndpoint().GetGkeCluster().GetResourceLink()]
+			if c == nil {
+				// Not a GKE cluster in this project, or filtered by location - use the gateway.
+				// With a location filter, GKE clusters were already filtered and other
+				// memberships must be in that location.
+				if loc != "-" && (m.GetEndpoint().GetGkeCluster() != nil || mloc != loc) {
+					continue
+				}
+				c = &Cluster{
+					Project:  p,
+					Location: mloc,
+					Name:     name,
+					Server:   fmt.Sprintf(connectGatewayURL, p, mloc, name),
+				}
+			}
+			c.Membership = m.Name
+			c.Labels = mergeLabels(c.Labels, m.Labels)
+			if f.Selector.Matches(labels.Set(c.Labels)) {
+				res = append(res, c)
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ContextName() < res[j].ContextName()
+	})
+	return res, nil
+}
+
+// membershipLocation returns the location from a membership name,
+// projects/P/locations/L/memberships/N.
+func membershipLocation(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) == 6 && parts[2] == "locations" {
+		return parts[3]
+	}
+	return "global"
+}
+
+// mergeLabels returns the GKE labels, with the membership labels added.
+func mergeLabels(gke, hub map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range gke {
+		res[k] = v
+	}
+	for k, v := range hub {
+		if _, f := res[k]; !f {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// KubeConfig returns a config with one context per cluster, using the gcp auth provider.
+// The first cluster is the current context.
+func KubeConfig(cl []*Cluster) *clientcmdapi.Config {
+	kc := clientcmdapi.NewConfig()
+	kc.AuthInfos["gcp"] = &clientcmdapi.AuthInfo{
+		AuthProvider: &clientcmdapi.AuthProviderConfig{Name: "gcp"},
+	}
+	for _, c := range cl {
+		n := c.ContextName()
+		kc.Clusters[n] = &clientcmdapi.Cluster{
+			Server:                   c.Server,
+			CertificateAuthorityData: c.CAData,
+		}
+		kc.Contexts[n] = &clientcmdapi.Context{Cluster: n, AuthInfo: "gcp"}
+		if kc.CurrentContext == "" {
+			kc.CurrentContext = n
+		}
+	}
+	return kc
+}
+
+// RemoteKubeConfig returns a minimal config for this cluster only, with the given
+// credentials, for use in an Istio remote secret.
+func (c *Cluster) RemoteKubeConfig(name string, ai *clientcmdapi.AuthInfo) *clientcmdapi.Config {
+	kc := clientcmdapi.NewConfig()
+	kc.Clusters[name] = &clientcmdapi.Cluster{
+		Server:                   c.Server,
+		CertificateAuthorityData: c.CAData,
+	}
+	kc.AuthInfos[name] = ai
+	kc.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+	kc.CurrentContext = name
+	return kc
+}
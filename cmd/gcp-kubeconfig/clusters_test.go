@@ -0,0 +1,91 @@
+//Copyright 2021 Google LLC
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestMembershipLocation(t *testing.T) {
+	for name, want := range map[string]string{
+		"projects/p/locations/us-central1/memberships/c1": "us-central1",
+		"projects/p/locations/global/memberships/c1":      "global",
+		"c1":                        "global",
+		"projects/p/memberships/c1": "global",
+	} {
+		if got := membershipLocation(name); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	gke := map[string]string{"mesh_id": "gke", "env": "prod"}
+	hub := map[string]string{"mesh_id": "hub", "team": "a"}
+	want := map[string]string{"mesh_id": "gke", "env": "prod", "team": "a"}
+	if got := mergeLabels(gke, hub); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if gke["team"] != "" {
+		t.Error("GKE labels modified")
+	}
+	if got := mergeLabels(nil, nil); len(got) != 0 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func testClusters() []*Cluster {
+	return []*Cluster{
+		{Project: "p", Location: "us-central1", Name: "c1", Server: "https://10.0.0.1", CAData: []byte("ca1")},
+		{Project: "p", Location: "us-east1", Name: "c2",
+			Server:     "https://connectgateway.googleapis.com/v1/projects/123/locations/us-east1/gkeMemberships/c2",
+			Membership: "projects/p/locations/us-east1/memberships/c2"},
+	}
+}
+
+func TestKubeConfig(t *testing.T) {
+	cl := testClusters()
+	kc := KubeConfig(cl)
+	if kc.CurrentContext != "gke_p_us-central1_c1" {
+		t.Errorf("current context %s", kc.CurrentContext)
+	}
+	if len(kc.Clusters) != 2 || len(kc.Contexts) != 2 || len(kc.AuthInfos) != 1 {
+		t.Fatalf("unexpected config %v", kc)
+	}
+	for _, c := range cl {
+		n := c.ContextName()
+		if kc.Clusters[n].Server != c.Server || string(kc.Clusters[n].CertificateAuthorityData) != string(c.CAData) {
+			t.Errorf("%s: unexpected cluster %v", n, kc.Clusters[n])
+		}
+		if kc.Contexts[n].Cluster != n || kc.Contexts[n].AuthInfo != "gcp" {
+			t.Errorf("%s: unexpected context %v", n, kc.Contexts[n])
+		}
+	}
+}
+
+func TestRemoteKubeConfig(t *testing.T) {
+	c := testClusters()[0]
+	ai := &clientcmdapi.AuthInfo{TokenFile: "/var/run/token"}
+	kc := c.RemoteKubeConfig("c1", ai)
+	if len(kc.Clusters) != 1 || len(kc.Contexts) != 1 || len(kc.AuthInfos) != 1 || kc.CurrentContext != "c1" {
+		t.Fatalf("unexpected config %v", kc)
+	}
+	if kc.Clusters["c1"].Server != c.Server || kc.AuthInfos["c1"] != ai || kc.Contexts["c1"].AuthInfo != "c1" {
+		t.Errorf("unexpected config %v", kc)
+	}
+}
@@ -17,22 +17,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 
-	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/krun/pkg/logs"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 // IstioSecretTemplate generates a K8S Secret for GCP with istio annotations.
 // Requires a metadata server or ADC.json.
 //
-// params: cluster name, k8s ca and server
-const IstioSecretTemplate = `
-apiVersion: v1
+// params: cluster name and the kubeconfig of that cluster
+const IstioSecretTemplate = `apiVersion: v1
 kind: Secret
 metadata:
   annotations:
@@ -43,66 +47,154 @@ metadata:
   namespace: istio-system
 stringData:
   {{ .name }}: |
-    {{ .kubeConfig }}
+{{ indent 4 .kubeConfig }}
 ---
 `
 
-// Will create a kubeconfig and individual secrets, with all GKE and hub clusters.
+var (
+	projects = flag.String("projects", os.Getenv("PROJECT_ID"), "Comma separated list of projects. Default PROJECT_ID")
+	location = flag.String("location", os.Getenv("LOCATION"), "Zone or region of the clusters. Default LOCATION, or all")
+	selector = flag.String("l", "", "Label selector for the clusters, for example mesh_id=proj-123. Default mesh_id=MESH_ID if set")
+	fleet    = flag.Bool("fleet", false, "Only clusters registered in the Hub (Fleet), including non-GKE clusters using the Connect Gateway")
+	dryRun   = flag.Bool("dry-run", false, "List the matching clusters without writing any file")
+	out      = flag.String("out", "config", "File where the merged kubeconfig is saved")
+
+	secrets   = flag.String("secrets", ".", "Directory where the Istio remote secrets are saved, as "+SecretsFile+", '-' for stdout, empty to skip")
+	auth      = flag.String("auth", "exec", "Auth in the remote secrets: exec or token")
+	execCmd   = flag.String("exec-cmd", "gke-gcloud-auth-plugin", "Credential plugin used with -auth exec. Must be installed in the istiod image")
+	token     = flag.String("token", "", "Bearer token used with -auth token")
+	tokenFile = flag.String("token-file", "", "Token file, as seen by istiod, used with -auth token instead of -token")
+)
+
+var logger = logs.New("gcp-kubeconfig")
+
+// Will create a kubeconfig and the Istio remote secrets, for the GKE and hub clusters matching the flags.
 //
 func main() {
-	gcpProj := os.Getenv("PROJECT_ID")
-	//location := os.Getenv("LOCATION")
-	//cluster := os.Getenv("CLUSTER")
-
-	// Used to provide access to all clusteres in the mesh
-	//meshID := os.Getenv("MESH_ID")
-
-	kr := mesh.New()
-	//if meshID == "" {
-	//  // if location is specified, create a single-cluster config.
-	//	err := kr.Mesh.CreateClusterConfig(gcpProj, location, cluster)
-	//	if err != nil {
-	//		panic(err)
-	//	}
-	//} else {
-	//kr.AllHub(gcpProj, cluster, meshIDLabel, meshID)
-	cl, err := gcp2.AllClusters(context.Background(), kr, "", "mesh_id", "")
+	logs.StdLog(logger)
+	flag.Parse()
+
+	if *projects == "" {
+		logger.Fatal("Missing -projects or PROJECT_ID")
+	}
+	sel := *selector
+	if sel == "" && os.Getenv("MESH_ID") != "" {
+		sel = "mesh_id=" + os.Getenv("MESH_ID")
+	}
+	ls, err := labels.Parse(sel)
+	if err != nil {
+		logger.Fatal("Invalid label selector", "selector", sel, "error", err)
+	}
+
+	cl, err := FindClusters(context.Background(), &Filter{
+		Projects: strings.Split(*projects, ","),
+		Location: *location,
+		Selector: ls,
+		Fleet:    *fleet,
+	})
 	if err != nil {
-		panic(err)
+		logger.Fatal("Failed to list clusters", "projects", *projects, "error", err)
 	}
 
 	if len(cl) == 0 {
-		log.Println("No clusters")
+		logger.Warn("No clusters", "projects", *projects, "selector", sel)
 		return
 	}
-	kc := cl[0].KubeConfig
-	for _, c := range cl {
-		gcp.MergeKubeConfig(kc, c.KubeConfig)
+	if *dryRun {
+		for _, c := range cl {
+			fmt.Printf("%s\t%s\t%s\n", c.ContextName(), c.Server, c.Membership)
+		}
+		return
+	}
+
+	kc := KubeConfig(cl)
+	err = clientcmd.WriteToFile(*kc, *out)
+	if err != nil {
+		logger.Fatal("Failed to save kubeconfig", "error", err)
+	}
+
+	if *secrets == "" {
+		return
+	}
+	ai, err := remoteAuth()
+	if err != nil {
+		logger.Fatal("Invalid remote secret auth", "error", err)
+	}
+	err = writeSecrets(cl, ai, *secrets)
+	if err != nil {
+		logger.Fatal("Failed to write remote secrets", "error", err)
+	}
+}
+
+// remoteAuth returns the credentials used by istiod to access the remote clusters.
+// User credentials from the local environment are never copied to the secrets.
+func remoteAuth() (*clientcmdapi.AuthInfo, error) {
+	switch *auth {
+	case "exec":
+		return &clientcmdapi.AuthInfo{
+			Exec: &clientcmdapi.ExecConfig{
+				APIVersion:         "client.authentication.k8s.io/v1beta1",
+				Command:            *execCmd,
+				ProvideClusterInfo: true,
+				InstallHint:        "Install " + *execCmd + " in the istiod image",
+			},
+		}, nil
+	case "token":
+		if *tokenFile != "" {
+			return &clientcmdapi.AuthInfo{TokenFile: *tokenFile}, nil
+		}
+		if *token == "" {
+			return nil, errors.New("-auth token requires -token or -token-file")
+		}
+		return &clientcmdapi.AuthInfo{Token: *token}, nil
 	}
-	err = gcp.SaveKubeConfig(kc, "", "config")
+	return nil, fmt.Errorf("unknown -auth %q, expecting exec or token", *auth)
+}
+
+// SecretsFile is the name of the remote secrets file, in the -secrets directory.
+const SecretsFile = "istio-remote-secrets.yaml"
+
+// writeSecrets generates one Istio remote secret per cluster, each holding a kubeconfig for
+// that cluster only, as a multi-document YAML. dest is a directory, or "-" for stdout.
+func writeSecrets(cl []*Cluster, ai *clientcmdapi.AuthInfo, dest string) error {
+	buf, err := remoteSecrets(cl, ai)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if dest == "-" {
+		_, err = os.Stdout.Write(buf)
+		return err
 	}
+	// May include a token.
+	return ioutil.WriteFile(filepath.Join(dest, SecretsFile), buf, 0600)
+}
 
-	tmpl := template.New("secret")
-	tmpl, err = tmpl.Parse(IstioSecretTemplate)
+// remoteSecrets returns the remote secrets of the clusters, as a multi-document YAML.
+func remoteSecrets(cl []*Cluster, ai *clientcmdapi.AuthInfo) ([]byte, error) {
+	tmpl, err := template.New("secret").Funcs(template.FuncMap{
+		"indent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+pad)
+		},
+	}).Parse(IstioSecretTemplate)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	buf := &bytes.Buffer{}
 	for _, c := range cl {
-		buf := &bytes.Buffer{}
-		cn := "gke_" + gcpProj + "_" + c.ClusterLocation + "_" + c.ClusterName
-		cn = strings.ReplaceAll(cn, "_", "-")
-		cfgjs, err := clientcmd.Write(*kc)
+		cn := strings.ReplaceAll(c.ContextName(), "_", "-")
+		cfgjs, err := clientcmd.Write(*c.RemoteKubeConfig(cn, ai))
 		if err != nil {
-			continue
+			return nil, err
 		}
-		tmpl.Execute(buf, map[string]string{
+		err = tmpl.Execute(buf, map[string]string{
 			"name":       cn,
 			"kubeConfig": string(cfgjs),
 		})
-
-		ioutil.WriteFile("secret-"+cn+".yaml", buf.Bytes(), 0700)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,121 @@
+//Copyright 2021 Google LLC
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestRemoteAuth(t *testing.T) {
+	defer func(a, tk, tf string) { *auth, *token, *tokenFile = a, tk, tf }(*auth, *token, *tokenFile)
+
+	*auth = "exec"
+	ai, err := remoteAuth()
+	if err != nil || ai.Exec == nil || ai.Exec.Command != *execCmd || ai.Token != "" || ai.AuthProvider != nil {
+		t.Errorf("exec: unexpected auth %v %v", ai, err)
+	}
+
+	*auth, *tokenFile, *token = "token", "/var/run/secrets/remote/token", "tok"
+	if ai, err = remoteAuth(); err != nil || ai.TokenFile != *tokenFile || ai.Token != "" {
+		t.Errorf("token file: unexpected auth %v %v", ai, err)
+	}
+	*tokenFile = ""
+	if ai, err = remoteAuth(); err != nil || ai.Token != "tok" {
+		t.Errorf("token: unexpected auth %v %v", ai, err)
+	}
+	*token = ""
+	if _, err = remoteAuth(); err == nil {
+		t.Error("token auth without token accepted")
+	}
+	*auth = "gcp"
+	if _, err = remoteAuth(); err == nil {
+		t.Error("unknown auth accepted")
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(dir)
+	defer func(a string) { *auth = a }(*auth)
+	*auth = "exec"
+	ai, _ := remoteAuth()
+	cl := testClusters()
+
+	if err := writeSecrets(cl, ai, dir); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != SecretsFile || files[0].Mode().Perm() != 0600 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, SecretsFile))
+
+	dec := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for i := 0; ; i++ {
+		s := struct {
+			Metadata struct {
+				Name        string            `json:"name"`
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+			StringData map[string]string `json:"stringData"`
+		}{}
+		err := dec.Decode(&s)
+		if err == io.EOF {
+			if i != len(cl) {
+				t.Errorf("got %d secrets, want %d", i, len(cl))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(cl) {
+			t.Fatalf("extra secret %v", s.Metadata.Name)
+		}
+		c := cl[i]
+		cn := map[string]string{"c1": "gke-p-us-central1-c1", "c2": "gke-p-us-east1-c2"}[c.Name]
+		if s.Metadata.Name != "istio-remote-secret-"+cn || s.Metadata.Annotations["networking.istio.io/cluster"] != cn || len(s.StringData) != 1 {
+			t.Fatalf("unexpected secret %v", s)
+		}
+
+		// Only this cluster, with the istiod credentials.
+		kc, err := clientcmd.Load([]byte(s.StringData[cn]))
+		if err != nil {
+			t.Fatal(cn, err)
+		}
+		if len(kc.Clusters) != 1 || kc.Clusters[cn] == nil || kc.Clusters[cn].Server != c.Server {
+			t.Errorf("%s: unexpected clusters %v", cn, kc.Clusters)
+		}
+		if len(kc.AuthInfos) != 1 || kc.AuthInfos[cn] == nil {
+			t.Fatalf("%s: unexpected users %v", cn, kc.AuthInfos)
+		}
+		u := kc.AuthInfos[cn]
+		if u.Exec == nil || u.AuthProvider != nil || u.Token != "" || u.ClientKeyData != nil || u.Username != "" {
+			t.Errorf("%s: unexpected credentials %v", cn, u)
+		}
+	}
+
+	if err := writeSecrets(cl, ai, filepath.Join(dir, "missing")); err == nil {
+		t.Error("write error ignored")
+	}
+}
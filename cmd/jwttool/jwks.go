@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWK is a public key from a JWKS - RSA or EC.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a key set, as returned by the jwks_uri of an OIDC issuer.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// LoadJWKS reads a key set from a file or a http(s) URL.
+func LoadJWKS(src string) (*JWKS, error) {
+	data, err := readSource(src)
+	if err != nil {
+		return nil, err
+	}
+	ks := &JWKS{}
+	if err := json.Unmarshal(data, ks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %v", src, err)
+	}
+	return ks, nil
+}
+
+// DiscoverJWKS loads the key set of an OIDC issuer, using ISSUER/.well-known/openid-configuration.
+// The issuer in the document must match.
+func DiscoverJWKS(issuer string) (*JWKS, error) {
+	data, err := readSource(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	doc := struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OIDC discovery document: %v", err)
+	}
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("OIDC discovery document is for issuer %q, expecting %q", doc.Issuer, issuer)
+	}
+	if doc.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document has no jwks_uri")
+	}
+	return LoadJWKS(doc.JWKSURI)
+}
+
+func readSource(src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "https://") && !strings.HasPrefix(src, "http://") {
+		return ioutil.ReadFile(src)
+	}
+	res, err := httpClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: %d", src, res.StatusCode)
+	}
+	return data, nil
+}
+
+// Verify checks the signature with the key matching the kid, or with each key of the right type
+// if the token has no kid.
+func (j *JWT) Verify(ks *JWKS) error {
+	alg := j.Alg()
+	if alg == "" || alg == "none" {
+		return fmt.Errorf("unsigned token, alg %q", alg)
+	}
+	kid := j.Kid()
+	kty := "RSA"
+	if strings.HasPrefix(alg, "ES") {
+		kty = "EC"
+	}
+	tried := 0
+	var lastErr error
+	for _, k := range ks.Keys {
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		if k.Kty != kty {
+			continue
+		}
+		tried++
+		lastErr = k.verify(alg, []byte(j.signed), j.sig)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	if tried == 0 {
+		return fmt.Errorf("no key in the JWKS for kid %q alg %s", kid, alg)
+	}
+	return fmt.Errorf("invalid signature: %v", lastErr)
+}
+
+func (k *JWK) verify(alg string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	var h crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	hs := h.New()
+	hs.Write(signed)
+	digest := hs.Sum(nil)
+
+	switch alg[0:2] {
+	case "RS", "PS":
+		pub, err := k.rsaKey()
+		if err != nil {
+			return err
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, h, digest, sig, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, h, digest, sig)
+	case "ES":
+		pub, err := k.ecKey()
+		if err != nil {
+			return err
+		}
+		n := len(sig) / 2
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("ECDSA verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %s", alg)
+}
+
+func (k *JWK) rsaKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("key %s is %s, expecting RSA", k.Kid, k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (k *JWK) ecKey() (*ecdsa.PublicKey, error) {
+	var c elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		c = elliptic.P256()
+	case "P-384":
+		c = elliptic.P384()
+	case "P-521":
+		c = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: c, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+// newOIDCServer serves the discovery document, claiming to be issuer if set, and the key set.
+func newOIDCServer(issuer string, keys ...JWK) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			iss := issuer
+			if iss == "" {
+				iss = srv.URL
+			}
+			json.NewEncoder(w).Encode(map[string]string{"issuer": iss, "jwks_uri": srv.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(&JWKS{Keys: keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func TestVerify(t *testing.T) {
+	for _, kt := range []string{ca.KeyRSA2048, ca.KeyECDSAP256} {
+		ms, msrv := newMetadataServer(t, kt)
+		msrv.Close()
+		other, osrv := newMetadataServer(t, kt)
+		osrv.Close()
+
+		srv := newOIDCServer("", *ms.jwk(), *other.jwk())
+		ks, err := DiscoverJWKS(srv.URL)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if len(ks.Keys) != 2 {
+			t.Fatalf("%s: got %d keys", kt, len(ks.Keys))
+		}
+
+		now := time.Now()
+		token, _ := ms.sign(map[string]interface{}{"iss": srv.URL, "aud": "a", "exp": now.Add(time.Hour).Unix()})
+		j, err := ParseJWT(token)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if j.Alg() != ms.alg() {
+			t.Errorf("%s: alg %s", kt, j.Alg())
+		}
+		if err := j.Verify(ks); err != nil {
+			t.Errorf("%s: %v", kt, err)
+		}
+
+		// Tampered payload.
+		j.signed = strings.Replace(j.signed, ".", ".x", 1)
+		if err := j.Verify(ks); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+			t.Errorf("%s: tampered token accepted %v", kt, err)
+		}
+
+		// Unknown kid.
+		ms.kid = "unknown"
+		token, _ = ms.sign(map[string]interface{}{"iss": srv.URL, "aud": "a", "exp": now.Add(time.Hour).Unix()})
+		j, _ = ParseJWT(token)
+		if err := j.Verify(ks); err == nil || !strings.Contains(err.Error(), "no key") {
+			t.Errorf("%s: unknown kid accepted %v", kt, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestDiscoverJWKSErrors(t *testing.T) {
+	srv := newOIDCServer("https://other.example.com")
+	defer srv.Close()
+	if _, err := DiscoverJWKS(srv.URL); err == nil || !strings.Contains(err.Error(), "other.example.com") {
+		t.Errorf("issuer mismatch accepted %v", err)
+	}
+	if _, err := LoadJWKS(srv.URL + "/missing"); err == nil {
+		t.Error("missing JWKS accepted")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JWT is a decoded, not yet verified, token.
+type JWT struct {
+	Header map[string]interface{}
+	Claims map[string]interface{}
+
+	// signed is the header and payload, as sent.
+	signed string
+	sig    []byte
+}
+
+// ParseJWT decodes the header, payload and signature.
+func ParseJWT(token string) (*JWT, error) {
+	token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(token), "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expecting 3 parts in the JWT, got %d", len(parts))
+	}
+	j := &JWT{signed: parts[0] + "." + parts[1]}
+	if err := decodeSegment(parts[0], &j.Header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	if err := decodeSegment(parts[1], &j.Claims); err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	j.sig = sig
+	return j, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (j *JWT) str(m map[string]interface{}, k string) string {
+	s, _ := m[k].(string)
+	return s
+}
+
+// Alg returns the signing algorithm from the header.
+func (j *JWT) Alg() string {
+	return j.str(j.Header, "alg")
+}
+
+// Kid returns the key ID from the header.
+func (j *JWT) Kid() string {
+	return j.str(j.Header, "kid")
+}
+
+// Issuer returns the iss claim.
+func (j *JWT) Issuer() string {
+	return j.str(j.Claims, "iss")
+}
+
+// Audiences returns the aud claim - a string or a list.
+func (j *JWT) Audiences() []string {
+	switch a := j.Claims["aud"].(type) {
+	case string:
+		return []string{a}
+	case []interface{}:
+		res := []string{}
+		for _, e := range a {
+			if s, ok := e.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// Time returns a NumericDate claim.
+func (j *JWT) Time(claim string) (time.Time, bool) {
+	v, ok := j.Claims[claim].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// K8S returns the namespace and service account of a K8S token - projected or legacy.
+func (j *JWT) K8S() (ns, sa string) {
+	if k, ok := j.Claims["kubernetes.io"].(map[string]interface{}); ok {
+		ns = j.str(k, "namespace")
+		if s, ok := k["serviceaccount"].(map[string]interface{}); ok {
+			sa = j.str(s, "name")
+		}
+		return ns, sa
+	}
+	return j.str(j.Claims, "kubernetes.io/serviceaccount/namespace"),
+		j.str(j.Claims, "kubernetes.io/serviceaccount/service-account.name")
+}
+
+// CheckOptions are the claim checks.
+type CheckOptions struct {
+	// Audience must be one of the aud values, if set.
+	Audience string
+
+	// Issuer must match iss, if set.
+	Issuer string
+
+	// Skew allowed for exp and nbf.
+	Skew time.Duration
+
+	Now time.Time
+}
+
+// Check returns the reasons the token would be rejected - expired, not yet valid, wrong
+// audience or issuer.
+func (j *JWT) Check(opts *CheckOptions) []string {
+	res := []string{}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if exp, ok := j.Time("exp"); !ok {
+		res = append(res, "missing exp claim")
+	} else if now.After(exp.Add(opts.Skew)) {
+		res = append(res, fmt.Sprintf("expired at %v, %v ago", exp, now.Sub(exp).Round(time.Second)))
+	}
+	if nbf, ok := j.Time("nbf"); ok && now.Add(opts.Skew).Before(nbf) {
+		res = append(res, fmt.Sprintf("not valid before %v", nbf))
+	}
+	if opts.Audience != "" {
+		found := false
+		for _, a := range j.Audiences() {
+			if a == opts.Audience {
+				found = true
+			}
+		}
+		if !found {
+			res = append(res, fmt.Sprintf("audience %q not in %v", opts.Audience, j.Audiences()))
+		}
+	}
+	if opts.Issuer != "" && j.Issuer() != opts.Issuer {
+		res = append(res, fmt.Sprintf("issuer %q, expecting %q", j.Issuer(), opts.Issuer))
+	}
+	return res
+}
+
+// Print writes the header, the standard claims and the full payload.
+func (j *JWT) Print(w io.Writer) {
+	fmt.Fprintf(w, "Header:    alg=%s kid=%s typ=%s\n", j.Alg(), j.Kid(), j.str(j.Header, "typ"))
+	fmt.Fprintf(w, "Issuer:    %s\n", j.Issuer())
+	fmt.Fprintf(w, "Subject:   %s\n", j.str(j.Claims, "sub"))
+	fmt.Fprintf(w, "Audience:  %s\n", strings.Join(j.Audiences(), ", "))
+	for _, c := range []string{"iat", "nbf", "exp"} {
+		if t, ok := j.Time(c); ok {
+			fmt.Fprintf(w, "%-10s %v (%s)\n", c+":", t.UTC(), relTime(t))
+		}
+	}
+	if ns, sa := j.K8S(); ns != "" || sa != "" {
+		fmt.Fprintf(w, "K8S:       namespace=%s serviceaccount=%s\n", ns, sa)
+	}
+	if e := j.str(j.Claims, "email"); e != "" {
+		fmt.Fprintf(w, "Email:     %s\n", e)
+	}
+
+	keys := []string{}
+	for k := range j.Claims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "Claims:")
+	for _, k := range keys {
+		v, _ := json.MarshalIndent(j.Claims[k], "  ", "  ")
+		fmt.Fprintf(w, "  %s: %s\n", k, v)
+	}
+}
+
+func relTime(t time.Time) string {
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " ago"
+	}
+	return "in " + d.String()
+}
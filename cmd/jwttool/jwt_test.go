@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+func TestCheck(t *testing.T) {
+	ms, srv := newMetadataServer(t, ca.KeyECDSAP256)
+	srv.Close()
+	now := time.Now()
+
+	for name, tc := range map[string]struct {
+		claims map[string]interface{}
+		opts   *CheckOptions
+		want   string
+	}{
+		"valid":    {map[string]interface{}{"iss": "i", "aud": []string{"a", "b"}, "exp": now.Add(time.Hour).Unix()}, &CheckOptions{Issuer: "i", Audience: "b"}, ""},
+		"expired":  {map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}, &CheckOptions{}, "expired"},
+		"skew":     {map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}, &CheckOptions{Skew: 5 * time.Minute}, ""},
+		"no exp":   {map[string]interface{}{}, &CheckOptions{}, "missing exp"},
+		"nbf":      {map[string]interface{}{"exp": now.Add(2 * time.Hour).Unix(), "nbf": now.Add(time.Hour).Unix()}, &CheckOptions{}, "not valid before"},
+		"audience": {map[string]interface{}{"aud": "a", "exp": now.Add(time.Hour).Unix()}, &CheckOptions{Audience: "b"}, "audience"},
+		"issuer":   {map[string]interface{}{"iss": "i", "exp": now.Add(time.Hour).Unix()}, &CheckOptions{Issuer: "other"}, "issuer"},
+	} {
+		token, err := ms.sign(tc.claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := ParseJWT("Bearer " + token)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		res := j.Check(tc.opts)
+		if tc.want == "" && len(res) != 0 || tc.want != "" && (len(res) != 1 || !strings.Contains(res[0], tc.want)) {
+			t.Errorf("%s: got %v, expecting %q", name, res, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"a.b", "a.b.c", "e30.e30.!"} {
+		if _, err := ParseJWT(bad); err == nil {
+			t.Errorf("invalid token %q accepted", bad)
+		}
+	}
+}
+
+func TestK8SClaims(t *testing.T) {
+	j := &JWT{Claims: map[string]interface{}{
+		"kubernetes.io": map[string]interface{}{
+			"namespace":      "ns",
+			"serviceaccount": map[string]interface{}{"name": "sa"},
+		},
+	}}
+	if ns, sa := j.K8S(); ns != "ns" || sa != "sa" {
+		t.Errorf("got %s %s", ns, sa)
+	}
+	j = &JWT{Claims: map[string]interface{}{
+		"kubernetes.io/serviceaccount/namespace":            "ns1",
+		"kubernetes.io/serviceaccount/service-account.name": "sa1",
+	}}
+	if ns, sa := j.K8S(); ns != "ns1" || sa != "sa1" {
+		t.Errorf("legacy token: got %s %s", ns, sa)
+	}
+}
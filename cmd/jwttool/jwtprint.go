@@ -17,20 +17,95 @@ package main
 import (
 	"flag"
 	"fmt"
-
-	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 )
 
 var (
-	decode = flag.String("d", "", "Decode token")
+	decode   = flag.String("d", "", "Token to decode. '-' reads the token from stdin, @FILE from a file")
+	jwks     = flag.String("jwks", "", "JWKS file or URL used to verify the signature")
+	discover = flag.Bool("oidc", false, "Verify using the JWKS from the OIDC discovery document of the -issuer")
+	issuer   = flag.String("issuer", "", "Expected issuer, required with -oidc")
+	aud      = flag.String("aud", "", "Expected audience")
+	skew     = flag.Duration("skew", time.Minute, "Clock skew allowed for exp and nbf")
 )
 
+// jwttool decodes and checks JWTs - K8S, STS, GCP tokens - without sending them to external sites.
+//
+// The exit code is 0 if the token is valid, 1 if a check failed and 2 if the token or keys can't be loaded.
+// The expiry is always checked, the signature only if -jwks or -oidc are set.
+//
+// 'jwttool mint' gets tokens using the same token sources as krun, and 'jwttool metadata' emulates
+// the GCE metadata server for local development.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mint" {
+		mintMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "metadata" {
+		metadataMain(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
-	if *decode != "" {
-		fmt.Println(mesh.TokenPayload(*decode))
-		return
+	if *decode == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	token, err := readToken(*decode)
+	if err != nil {
+		fail(2, "Failed to read token: %v", err)
 	}
+	j, err := ParseJWT(token)
+	if err != nil {
+		fail(2, "Invalid JWT: %v", err)
+	}
+	j.Print(os.Stdout)
+
+	problems := j.Check(&CheckOptions{Audience: *aud, Issuer: *issuer, Skew: *skew})
+
+	var ks *JWKS
+	switch {
+	case *jwks != "":
+		ks, err = LoadJWKS(*jwks)
+	case *discover:
+		// The iss claim is not trusted before the signature is checked - a token could point to any keys.
+		if *issuer == "" {
+			fail(2, "-oidc requires -issuer, the token issuer is %q", j.Issuer())
+		}
+		ks, err = DiscoverJWKS(*issuer)
+	}
+	if err != nil {
+		fail(2, "Failed to load keys: %v", err)
+	}
+	if ks != nil {
+		if err := j.Verify(ks); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			fmt.Println("Signature: valid")
+		}
+	}
+
+	if len(problems) > 0 {
+		fail(1, "Invalid token: %s", strings.Join(problems, "; "))
+	}
+}
+
+func readToken(src string) (string, error) {
+	switch {
+	case src == "-":
+		b, err := ioutil.ReadAll(os.Stdin)
+		return string(b), err
+	case strings.HasPrefix(src, "@"):
+		b, err := ioutil.ReadFile(src[1:])
+		return string(b), err
+	}
+	return src, nil
+}
 
+func fail(code int, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(code)
 }
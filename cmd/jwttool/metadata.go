@@ -0,0 +1,336 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+const metadataPrefix = "/computeMetadata/v1/"
+
+// MetadataServer emulates the GCE metadata endpoints used by krun - project, location,
+// service account, access and ID tokens - for running krun on a laptop or in offline tests.
+//
+// ID tokens are signed with a local key, published at /jwks with OIDC discovery at the issuer.
+// With Gcloud, the tokens are the real ones for the gcloud credentials.
+type MetadataServer struct {
+	ProjectID       string
+	ProjectNumber   string
+	Zone            string
+	Email           string
+	ClusterName     string
+	ClusterLocation string
+
+	// Issuer of the ID tokens - the URL of this server.
+	Issuer string
+
+	// Gcloud uses 'gcloud auth' for tokens.
+	Gcloud bool
+
+	key crypto.Signer
+	kid string
+}
+
+// metadataMain implements 'jwttool metadata'.
+func metadataMain(args []string) {
+	fs := flag.NewFlagSet("metadata", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8089", "Listen address. Set GCE_METADATA_HOST to this address for krun")
+	ms := &MetadataServer{}
+	fs.StringVar(&ms.ProjectID, "project", "local-project", "Project ID")
+	fs.StringVar(&ms.ProjectNumber, "project-number", "123456789", "Numeric project ID")
+	fs.StringVar(&ms.Zone, "zone", "us-central1-c", "Zone - the region is derived from it")
+	fs.StringVar(&ms.Email, "email", "", "Service account email, default k8s@PROJECT.iam.gserviceaccount.com")
+	fs.StringVar(&ms.ClusterName, "cluster-name", "", "cluster-name instance attribute, as on GKE nodes")
+	fs.StringVar(&ms.ClusterLocation, "cluster-location", "", "cluster-location instance attribute, as on GKE nodes")
+	fs.StringVar(&ms.Issuer, "issuer", "", "Issuer of the ID tokens, default http://ADDR")
+	fs.BoolVar(&ms.Gcloud, "gcloud", false, "Return the tokens of the gcloud credentials instead of local tokens")
+	keyFile := fs.String("key", "", "PEM private key signing the ID tokens, RSA or ECDSA P-256. Default a new RSA key")
+	fs.Parse(args)
+
+	if ms.Email == "" {
+		ms.Email = "k8s@" + ms.ProjectID + ".iam.gserviceaccount.com"
+	}
+	if ms.Issuer == "" {
+		ms.Issuer = "http://" + *addr
+	}
+	var err error
+	if *keyFile != "" {
+		var pemKey []byte
+		pemKey, err = ioutil.ReadFile(*keyFile)
+		if err == nil {
+			ms.key, err = ca.ParsePrivateKey(pemKey)
+		}
+	} else {
+		ms.key, err = ca.GenerateKey(ca.KeyRSA2048)
+	}
+	if err != nil {
+		fail(2, "Failed to load signing key: %v", err)
+	}
+	if err = ms.initKey(); err != nil {
+		fail(2, "Invalid signing key: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Metadata server on %s, use:\nexport GCE_METADATA_HOST=%s\n", *addr, *addr)
+	if err := http.ListenAndServe(*addr, ms); err != nil {
+		fail(2, "Failed to start metadata server: %v", err)
+	}
+}
+
+// initKey computes the key ID, from the hash of the public key.
+func (ms *MetadataServer) initKey() error {
+	switch k := ms.key.Public().(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize != 256 {
+			return errors.New("only P-256 ECDSA keys are supported")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %s", ca.KeyType(k))
+	}
+	jwk, _ := json.Marshal(ms.jwk())
+	sum := sha256.Sum256(jwk)
+	ms.kid = hex.EncodeToString(sum[:8])
+	return nil
+}
+
+func (ms *MetadataServer) region() string {
+	if i := strings.LastIndex(ms.Zone, "-"); i > 0 {
+		return ms.Zone[:i]
+	}
+	return ms.Zone
+}
+
+func (ms *MetadataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Metadata-Flavor", "Google")
+	switch r.URL.Path {
+	case "/":
+		// Used by clients to detect the metadata server.
+		return
+	case "/.well-known/openid-configuration":
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                ms.Issuer,
+			"jwks_uri":                              ms.Issuer + "/jwks",
+			"id_token_signing_alg_values_supported": []string{ms.alg()},
+		})
+		return
+	case "/jwks":
+		writeJSON(w, map[string]interface{}{"keys": []interface{}{ms.jwk()}})
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, metadataPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+		return
+	}
+
+	sa := "instance/service-accounts/default/"
+	if p := strings.TrimPrefix(r.URL.Path, metadataPrefix); strings.HasPrefix(p, "instance/service-accounts/") {
+		// The email can be used instead of 'default'
+		p = strings.TrimPrefix(p, "instance/service-accounts/")
+		if i := strings.Index(p, "/"); i > 0 && (p[:i] == "default" || p[:i] == ms.Email) {
+			r.URL.Path = metadataPrefix + sa + p[i+1:]
+		}
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, metadataPrefix) {
+	case "project/project-id":
+		fmt.Fprint(w, ms.ProjectID)
+	case "project/numeric-project-id":
+		fmt.Fprint(w, ms.ProjectNumber)
+	case "instance/zone":
+		fmt.Fprint(w, "projects/"+ms.ProjectNumber+"/zones/"+ms.Zone)
+	case "instance/region":
+		fmt.Fprint(w, "projects/"+ms.ProjectNumber+"/regions/"+ms.region())
+	case "instance/attributes/cluster-name":
+		ms.writeAttr(w, r, ms.ClusterName)
+	case "instance/attributes/cluster-location":
+		ms.writeAttr(w, r, ms.ClusterLocation)
+	case "instance/service-accounts/":
+		fmt.Fprint(w, "default/\n"+ms.Email+"/\n")
+	case sa:
+		writeJSON(w, map[string]interface{}{
+			"aliases": []string{"default"},
+			"email":   ms.Email,
+			"scopes":  []string{"https://www.googleapis.com/auth/cloud-platform"},
+		})
+	case sa + "email":
+		fmt.Fprint(w, ms.Email)
+	case sa + "scopes":
+		fmt.Fprint(w, "https://www.googleapis.com/auth/cloud-platform\n")
+	case sa + "token":
+		token, err := ms.accessToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": token, "expires_in": 3599, "token_type": "Bearer"})
+	case sa + "identity":
+		aud := r.URL.Query().Get("audience")
+		if aud == "" {
+			http.Error(w, "missing audience parameter", http.StatusBadRequest)
+			return
+		}
+		token, err := ms.idToken(aud, r.URL.Query().Get("format") == "full")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, token)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ms *MetadataServer) writeAttr(w http.ResponseWriter, r *http.Request, v string) {
+	if v == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// accessToken returns the gcloud token, or an opaque local token.
+func (ms *MetadataServer) accessToken() (string, error) {
+	if ms.Gcloud {
+		return gcloud("auth", "print-access-token")
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ya29.local-" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// idToken returns the gcloud ID token, or a token signed with the local key, with the same
+// claims as the GCE ID tokens.
+func (ms *MetadataServer) idToken(aud string, full bool) (string, error) {
+	if ms.Gcloud {
+		return gcloud("auth", "print-identity-token", "--audiences="+aud)
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            ms.Issuer,
+		"aud":            aud,
+		"azp":            ms.Email,
+		"sub":            ms.Email,
+		"email":          ms.Email,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	if full {
+		claims["google"] = map[string]interface{}{
+			"compute_engine": map[string]interface{}{
+				"project_id":     ms.ProjectID,
+				"project_number": ms.ProjectNumber,
+				"zone":           ms.Zone,
+				"instance_name":  "local",
+			},
+		}
+	}
+	return ms.sign(claims)
+}
+
+func (ms *MetadataServer) alg() string {
+	if _, ok := ms.key.Public().(*ecdsa.PublicKey); ok {
+		return "ES256"
+	}
+	return "RS256"
+}
+
+func (ms *MetadataServer) sign(claims map[string]interface{}) (string, error) {
+	h, err := json.Marshal(map[string]string{"alg": ms.alg(), "kid": ms.kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	if ek, ok := ms.key.(*ecdsa.PrivateKey); ok {
+		// JWS uses r||s, not ASN.1.
+		sig, err = ecdsaJWS(ek, digest[:])
+	} else {
+		sig, err = ms.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func ecdsaJWS(k *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+	if err != nil {
+		return nil, err
+	}
+	return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+}
+
+// jwk returns the public key, in the format used by JWKS.
+func (ms *MetadataServer) jwk() *JWK {
+	switch k := ms.key.Public().(type) {
+	case *rsa.PublicKey:
+		return &JWK{Kty: "RSA", Kid: ms.kid, Alg: "RS256",
+			N: base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return &JWK{Kty: "EC", Kid: ms.kid, Alg: "ES256", Crv: "P-256",
+			X: base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+			Y: base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32)))}
+	}
+	return nil
+}
+
+func gcloud(args ...string) (string, error) {
+	out, err := exec.Command("gcloud", args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("gcloud %s: %v %s", args[1], err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+func newMetadataServer(t *testing.T, keyType string) (*MetadataServer, *httptest.Server) {
+	key, err := ca.GenerateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &MetadataServer{ProjectID: "p", ProjectNumber: "123", Zone: "us-central1-c",
+		Email: "k8s@p.iam.gserviceaccount.com", ClusterLocation: "us-central1", key: key}
+	if err := ms.initKey(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ms)
+	ms.Issuer = srv.URL
+	return ms, srv
+}
+
+func metadataGet(t *testing.T, url string, flavor bool) (int, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if flavor {
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestMetadataServer(t *testing.T) {
+	ms, srv := newMetadataServer(t, ca.KeyRSA2048)
+	defer srv.Close()
+	md := srv.URL + metadataPrefix
+
+	if code, _ := metadataGet(t, md+"project/project-id", false); code != http.StatusForbidden {
+		t.Errorf("request without Metadata-Flavor: got %d", code)
+	}
+	for path, want := range map[string]string{
+		"project/project-id":                               "p",
+		"project/numeric-project-id":                       "123",
+		"instance/zone":                                    "projects/123/zones/us-central1-c",
+		"instance/region":                                  "projects/123/regions/us-central1",
+		"instance/attributes/cluster-location":             "us-central1",
+		"instance/service-accounts/default/email":          ms.Email,
+		"instance/service-accounts/" + ms.Email + "/email": ms.Email,
+	} {
+		if code, body := metadataGet(t, md+path, true); code != 200 || body != want {
+			t.Errorf("%s: got %d %q, expecting %q", path, code, body, want)
+		}
+	}
+	for _, path := range []string{"instance/attributes/cluster-name", "instance/service-accounts/other/email", "other"} {
+		if code, _ := metadataGet(t, md+path, true); code != http.StatusNotFound {
+			t.Errorf("%s: got %d, expecting 404", path, code)
+		}
+	}
+
+	code, body := metadataGet(t, md+"instance/service-accounts/default/token", true)
+	tok := struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &tok); code != 200 || err != nil ||
+		!strings.HasPrefix(tok.AccessToken, "ya29.local-") || tok.TokenType != "Bearer" {
+		t.Errorf("unexpected access token %d %s", code, body)
+	}
+
+	if code, _ := metadataGet(t, md+"instance/service-accounts/default/identity", true); code != http.StatusBadRequest {
+		t.Errorf("ID token without audience: got %d", code)
+	}
+	code, body = metadataGet(t, md+"instance/service-accounts/default/identity?audience=https://example.com&format=full", true)
+	if code != 200 {
+		t.Fatalf("ID token: %d %s", code, body)
+	}
+	j, err := ParseJWT(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Issuer() != srv.URL || len(j.Audiences()) != 1 || j.Audiences()[0] != "https://example.com" ||
+		j.Claims["email"] != ms.Email || j.Claims["google"] == nil {
+		t.Errorf("unexpected claims %v", j.Claims)
+	}
+}
+
+func TestDiscoverJWKS(t *testing.T) {
+	for _, kt := range []string{ca.KeyRSA2048, ca.KeyECDSAP256} {
+		ms, srv := newMetadataServer(t, kt)
+
+		token, err := ms.idToken("aud", false)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		ks, err := DiscoverJWKS(srv.URL)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		j, _ := ParseJWT(token)
+		if err := j.Verify(ks); err != nil {
+			t.Errorf("%s: %v", kt, err)
+		}
+
+		// A token signed by another key with the same kid is rejected.
+		other, otherSrv := newMetadataServer(t, kt)
+		other.kid = ms.kid
+		forged, _ := other.idToken("aud", false)
+		j, _ = ParseJWT(forged)
+		if err := j.Verify(ks); err == nil {
+			t.Errorf("%s: forged token verified", kt)
+		}
+
+		// The discovery document must be for the requested issuer.
+		other.Issuer = srv.URL
+		if _, err := DiscoverJWKS(otherSrv.URL); err == nil {
+			t.Errorf("%s: accepted discovery document for another issuer", kt)
+		}
+
+		srv.Close()
+		otherSrv.Close()
+	}
+}
+
+func TestInitKey(t *testing.T) {
+	for kt, ok := range map[string]bool{ca.KeyRSA2048: true, ca.KeyECDSAP256: true, ca.KeyECDSAP384: false, ca.KeyEd25519: false} {
+		key, err := ca.GenerateKey(kt)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		ms := &MetadataServer{key: key}
+		if err := ms.initKey(); (err == nil) != ok {
+			t.Errorf("%s: unexpected result %v", kt, err)
+		}
+		if ok && ms.kid == "" {
+			t.Errorf("%s: no kid", kt)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/sts"
+)
+
+// mintType describes a token, and the audience used by default - the same as the krun, certtool
+// and OTel exporter requests.
+type mintType struct {
+	help string
+	aud  string
+}
+
+var mintTypes = map[string]mintType{
+	"k8s":    {"K8S TokenRequest token for the KSA", "istio-ca"},
+	"id":     {"GCP ID token from the metadata server", ""},
+	"meshca": {"STS token sent to MeshCA", "https://meshca.googleapis.com/google.security.meshca.v1.MeshCertificateService"},
+	"cas":    {"STS federated access token sent to CAS", "https://privateca.googleapis.com/google.cloud.security.privateca.v1.CertificateAuthorityService"},
+	"trace":  {"STS token sent to Cloud Trace by the OTel exporter", "https://cloudtrace.googleapis.com/google.devtools.cloudtrace.v2.TraceService"},
+}
+
+func mintTypeNames() string {
+	res := []string{}
+	for k := range mintTypes {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ", ")
+}
+
+// mintMain implements 'jwttool mint' - get a token using the same token sources as krun.
+// The cluster is found using KUBECONFIG or the in-cluster config.
+func mintMain(args []string) {
+	fs := flag.NewFlagSet("mint", flag.ExitOnError)
+	typ := fs.String("type", "k8s", "Token type: "+mintTypeNames())
+	aud := fs.String("aud", "", "Audience. Default depends on the type - required for id")
+	ns := fs.String("n", "", "Namespace, default from the environment")
+	ksa := fs.String("ksa", "", "K8S service account, default from the environment")
+	out := fs.String("out", "", "File where the token is saved. Default stdout")
+	show := fs.Bool("decode", false, "Also print the decoded token, on stderr")
+	fs.Parse(args)
+
+	mt, ok := mintTypes[*typ]
+	if !ok {
+		fail(2, "Unknown token type %q, expecting %s", *typ, mintTypeNames())
+	}
+	if *aud == "" {
+		*aud = mt.aud
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+
+	var token string
+	var err error
+	if *typ == "id" {
+		token, err = metadataIDToken(ctx, *aud)
+	} else {
+		kr := mesh.New()
+		if *ns != "" {
+			kr.Namespace = *ns
+		}
+		if *ksa != "" {
+			kr.KSA = *ksa
+		}
+		// KUBECONFIG or in-cluster - GKE discovery would pull in the GCP container API.
+		kc := &k8s.K8S{Mesh: kr}
+		err = kc.K8SClient(ctx)
+		if err == nil {
+			kr.Cfg = kc
+			kr.TokenProvider = kc
+			err = kr.LoadConfig(ctx)
+		}
+		if err != nil {
+			fail(2, "Failed to initialize K8S and mesh config: %v", err)
+		}
+		token, err = mint(ctx, kr, *typ, *aud)
+	}
+	if err != nil {
+		fail(1, "Failed to get %s token: %v", *typ, err)
+	}
+
+	if *show {
+		if j, err := ParseJWT(token); err == nil {
+			j.Print(os.Stderr)
+		} else {
+			// Access tokens are opaque.
+			fmt.Fprintf(os.Stderr, "Not a JWT: %v\n", err)
+		}
+	}
+	if *out == "" {
+		fmt.Println(token)
+		return
+	}
+	if err := ioutil.WriteFile(*out, []byte(token), 0600); err != nil {
+		fail(2, "Failed to save token: %v", err)
+	}
+}
+
+// mint returns a K8S token or an STS token, configured like the krun CA and OTel clients.
+func mint(ctx context.Context, kr *mesh.KRun, typ, aud string) (string, error) {
+	if typ == "k8s" {
+		return kr.GetToken(ctx, aud)
+	}
+	s, err := sts.NewSTS(kr)
+	if err != nil {
+		return "", err
+	}
+	switch typ {
+	case "meshca":
+		s.UseAccessToken = false
+	case "cas":
+		s.UseAccessToken = true
+	case "trace":
+		s.MDPSA = true
+		s.UseAccessToken = true
+	}
+	md, err := s.GetRequestMetadata(ctx, aud)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range md {
+		if strings.EqualFold(k, "authorization") {
+			return strings.TrimPrefix(v, "Bearer "), nil
+		}
+	}
+	return "", errors.New("no authorization header from STS")
+}
+
+// metadataIDToken gets a GCP ID token from the metadata server, or GCE_METADATA_HOST.
+func metadataIDToken(ctx context.Context, aud string) (string, error) {
+	if aud == "" {
+		return "", errors.New("-aud is required for ID tokens")
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	u := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/identity?format=full&audience=" +
+		url.QueryEscape(aud)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("metadata server %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,319 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/hbone"
+	"github.com/costinm/krun/pkg/logs"
+)
+
+// Admin is the local status server. Default address is 127.0.0.1:15019, KRUN_ADMIN_ADDR
+//
+// Only loopback addresses are accepted - operators can access it using the debug SSH or port-forward.
+type Admin struct {
+	Addr string
+	Mux  *http.ServeMux
+
+	KRun  *mesh.KRun
+	App   *App
+	Ready *ReadyCheck
+
+	// EnvoyAdmin is the admin address of envoy, empty if envoy is not running.
+	EnvoyAdmin string
+
+	sup *Supervisor
+
+	m     sync.RWMutex
+	auth  *hbone.Auth
+	hbone *HBoneServer
+}
+
+// NewAdmin creates the admin server, with the JSON endpoints:
+//
+// - /status - components health
+// - /config - the resolved mesh config
+// - /certs - the workload certificate chain and expiry
+// - /hbone - HBONE connection and stream counts
+// - /h2r - H2R attachments state
+// - /app - app process state
+// - /ready - envoy and app readiness
+func NewAdmin(sup *Supervisor) *Admin {
+	a := &Admin{
+		Addr: os.Getenv("KRUN_ADMIN_ADDR"),
+		Mux:  http.NewServeMux(),
+		sup:  sup,
+	}
+	if a.Addr == "" {
+		a.Addr = "127.0.0.1:15019"
+	}
+	a.Mux.HandleFunc("/status", a.handleStatus)
+	a.Mux.HandleFunc("/h2r", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, H2RStatusAll())
+	})
+	a.Mux.HandleFunc("/config", a.handleConfig)
+	a.Mux.HandleFunc("/certs", a.handleCerts)
+	a.Mux.HandleFunc("/hbone", a.handleHBone)
+	a.Mux.HandleFunc("/app", a.handleApp)
+	a.Mux.HandleFunc("/ready", a.handleReady)
+	return a
+}
+
+// SetAuth sets the mesh certificates, once provisioned.
+func (a *Admin) SetAuth(auth *hbone.Auth) {
+	a.m.Lock()
+	a.auth = auth
+	a.m.Unlock()
+}
+
+// SetHBone sets the HBONE server, once started.
+func (a *Admin) SetHBone(hs *HBoneServer) {
+	a.m.Lock()
+	a.hbone = hs
+	a.m.Unlock()
+}
+
+// Run serves the admin requests until ctx is done.
+func (a *Admin) Run(ctx context.Context) error {
+	if err := checkLoopback(a.Addr); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", a.Addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: a.Mux}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		srv.Close()
+	}()
+	err = srv.Serve(l)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// checkLoopback returns an error if addr is not a loopback host:port. The admin server exposes the
+// mesh config and certs, and has no authentication.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("KRUN_ADMIN_ADDR %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// handleStatus returns the components health, with 503 if a critical component is not running.
+func (a *Admin) handleStatus(w http.ResponseWriter, r *http.Request) {
+	healthy := a.sup.Healthy()
+	code := http.StatusOK
+	if !healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"healthy":    healthy,
+		"components": a.sup.Status(),
+	})
+}
+
+// handleConfig returns the mesh config loaded from env and mesh-env, and the environment - with the secrets
+// redacted.
+func (a *Admin) handleConfig(w http.ResponseWriter, r *http.Request) {
+	kr := a.KRun
+	if kr == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not loaded"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"projectId":         kr.ProjectId,
+		"projectNumber":     kr.ProjectNumber,
+		"clusterName":       kr.ClusterName,
+		"clusterLocation":   kr.ClusterLocation,
+		"clusterAddress":    kr.ClusterAddress,
+		"namespace":         kr.Namespace,
+		"name":              kr.Name,
+		"ksa":               kr.KSA,
+		"labels":            kr.Labels,
+		"trustDomain":       kr.TrustDomain,
+		"xdsAddr":           kr.XDSAddr,
+		"meshConnectorAddr": kr.MeshConnectorAddr,
+		"citadelRoot":       kr.CitadelRoot != "",
+		"startTime":         kr.StartTime,
+		"env":               logs.RedactEnv(os.Environ()),
+	})
+}
+
+// CertInfo describes a certificate in the workload chain.
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	URIs      []string  `json:"uris,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	ExpiresIn string    `json:"expiresIn"`
+}
+
+// handleCerts returns the workload certificate chain, and the renewal state if krun manages the certs.
+func (a *Admin) handleCerts(w http.ResponseWriter, r *http.Request) {
+	a.m.RLock()
+	auth := a.auth
+	a.m.RUnlock()
+	var cert *tls.Certificate
+	if auth != nil {
+		cert = workloadCert(auth)
+	}
+	if cert == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no certificate"})
+		return
+	}
+	chain := []CertInfo{}
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		ci := CertInfo{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			Serial:    c.SerialNumber.String(),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+			ExpiresIn: time.Until(c.NotAfter).Round(time.Second).String(),
+		}
+		for _, u := range c.URIs {
+			ci.URIs = append(ci.URIs, u.String())
+		}
+		chain = append(chain, ci)
+	}
+	res := map[string]interface{}{"chain": chain}
+	if certRenewer != nil {
+		res["nextRenewal"] = certRenewer.NextRenewal()
+		if err := certRenewer.LastError(); err != nil {
+			res["lastError"] = err.Error()
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *Admin) handleHBone(w http.ResponseWriter, r *http.Request) {
+	a.m.RLock()
+	hs := a.hbone
+	a.m.RUnlock()
+	if hs == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not started"})
+		return
+	}
+	writeJSON(w, http.StatusOK, hs.Stats())
+}
+
+// handleApp returns the app process state.
+func (a *Admin) handleApp(w http.ResponseWriter, r *http.Request) {
+	app := a.App
+	if app == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no app"})
+		return
+	}
+	res := map[string]interface{}{
+		"args":    app.Cmd.Args,
+		"pid":     app.Cmd.Process.Pid,
+		"started": app.Started,
+		"running": app.Running(),
+	}
+	if !app.Running() {
+		res["exitCode"] = app.ExitCode()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleReady probes envoy and the app, with 503 if one of them is not ready.
+func (a *Admin) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cf := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cf()
+	code := http.StatusOK
+	res := map[string]interface{}{}
+
+	if a.EnvoyAdmin != "" {
+		err := envoyReady(ctx, a.EnvoyAdmin)
+		res["envoy"] = readyState(err)
+		if err != nil {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	if a.Ready != nil && a.App != nil {
+		err := a.Ready.Probe(ctx)
+		res["app"] = readyState(err)
+		if err != nil {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, res)
+}
+
+func readyState(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ready"
+}
+
+// envoyReady checks the envoy /ready admin endpoint.
+func envoyReady(ctx context.Context, admin string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+admin+"/ready", nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("envoy not ready: %d", res.StatusCode)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
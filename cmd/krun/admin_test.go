@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:15019", "[::1]:15019", "localhost:15019", "127.0.0.2:0"} {
+		if err := checkLoopback(addr); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{":15019", "0.0.0.0:15019", "[::]:15019", "10.0.0.1:15019", "admin:15019", "127.0.0.1"} {
+		if err := checkLoopback(addr); err == nil {
+			t.Errorf("%s: expecting error", addr)
+		}
+	}
+}
+
+func TestHandleConfig(t *testing.T) {
+	os.Setenv("KRUN_TEST_TOKEN", "abc")
+	defer os.Unsetenv("KRUN_TEST_TOKEN")
+	a := &Admin{KRun: mesh.New()}
+	w := httptest.NewRecorder()
+	a.handleConfig(w, httptest.NewRequest("GET", "/config", nil))
+	res := struct {
+		Env []string `json:"env"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range res.Env {
+		if e == "KRUN_TEST_TOKEN=abc" {
+			t.Error("secret not redacted")
+		}
+		found = found || e == "KRUN_TEST_TOKEN=[REDACTED]"
+	}
+	if !found {
+		t.Errorf("missing env %v", res.Env)
+	}
+}
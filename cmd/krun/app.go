@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/krun/pkg/logs"
+)
+
+// App is the application started by krun, using the rest of the command line.
+//
+// krun keeps the process, to forward signals and exit with the same code.
+type App struct {
+	Cmd *exec.Cmd
+
+	// Started is the time the app process was started.
+	Started time.Time
+
+	done     chan struct{}
+	m        sync.Mutex
+	exitCode int
+	err      error
+}
+
+// StartApp starts the app, if a command was provided. The process is configured like mesh.KRun.StartApp:
+//   - as in CloudRun, PORT is set to 8080 - the HBONE port (15009) is used by krun
+//   - if running as root, the app runs as K8S_UID, if set
+//   - proxyless gRPC uses the bootstrap generated by the agent, unless GRPC_XDS_BOOTSTRAP is set
+//   - in whitebox mode (no iptables capture) HTTP_PROXY points to the envoy outbound listener
+func StartApp(kr *mesh.KRun, args []string) (*App, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if os.Getuid() == 0 {
+		if uid := os.Getenv("K8S_UID"); uid != "" {
+			uidi, err := strconv.Atoi(uid)
+			if err != nil {
+				return nil, fmt.Errorf("invalid K8S_UID %s: %v", uid, err)
+			}
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Credential: &syscall.Credential{Uid: uint32(uidi)},
+			}
+		}
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = appEnv(kr, os.Environ())
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	appLog.Info("App started", "cmd", strings.Join(args, " "), "pid", cmd.Process.Pid)
+	appLog.Debug("App environment", "env", logs.RedactEnv(cmd.Env))
+	a := &App{Cmd: cmd, Started: time.Now(), done: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		a.m.Lock()
+		a.err = err
+		a.exitCode = exitCode(cmd.ProcessState)
+		a.m.Unlock()
+		appLog.Info("App exited", "exitCode", a.exitCode, "error", err)
+		close(a.done)
+	}()
+	return a, nil
+}
+
+// exitCode returns the exit code of the process, or 128+signal if it was killed by a signal -
+// like a shell, and the container runtimes.
+func exitCode(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
+
+// appEnv returns the app environment.
+func appEnv(kr *mesh.KRun, environ []string) []string {
+	env := []string{"PORT=8080"}
+	bootstrap := false
+	for _, e := range environ {
+		if strings.HasPrefix(e, "PORT=") {
+			continue
+		}
+		if strings.HasPrefix(e, "GRPC_XDS_BOOTSTRAP=") && e != "GRPC_XDS_BOOTSTRAP=" {
+			bootstrap = true
+		}
+		env = append(env, e)
+	}
+	if !bootstrap {
+		env = append(env, "GRPC_XDS_BOOTSTRAP=/etc/istio/proxy/grpc_bootstrap.json",
+			// This is set by injector
+			"GRPC_XDS_EXPERIMENTAL_RBAC=true",
+			"GRPC_XDS_EXPERIMENTAL_SECURITY_SUPPORT=true")
+	}
+	if kr.WhiteboxMode {
+		env = append(env, "HTTP_PROXY=127.0.0.1:15007", "http_proxy=127.0.0.1:15007")
+	}
+	return env
+}
+
+// Signal forwards a signal to the app.
+func (a *App) Signal(sig os.Signal) error {
+	select {
+	case <-a.done:
+		return nil
+	default:
+	}
+	return a.Cmd.Process.Signal(sig)
+}
+
+// Done is closed when the app exits.
+func (a *App) Done() <-chan struct{} {
+	return a.done
+}
+
+// ExitCode returns the app exit code, 128+signal if killed by a signal.
+func (a *App) ExitCode() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.exitCode
+}
+
+// Running returns true if the app process is still running.
+func (a *App) Running() bool {
+	select {
+	case <-a.done:
+		return false
+	default:
+		return true
+	}
+}
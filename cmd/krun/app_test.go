@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func TestAppEnv(t *testing.T) {
+	kr := mesh.New()
+	env := appEnv(kr, []string{"PORT=15009", "A=1"})
+	want := []string{"PORT=8080", "A=1",
+		"GRPC_XDS_BOOTSTRAP=/etc/istio/proxy/grpc_bootstrap.json",
+		"GRPC_XDS_EXPERIMENTAL_RBAC=true",
+		"GRPC_XDS_EXPERIMENTAL_SECURITY_SUPPORT=true"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %v, want %v", env, want)
+	}
+
+	kr.WhiteboxMode = true
+	env = appEnv(kr, []string{"GRPC_XDS_BOOTSTRAP=/x.json"})
+	want = []string{"PORT=8080", "GRPC_XDS_BOOTSTRAP=/x.json",
+		"HTTP_PROXY=127.0.0.1:15007", "http_proxy=127.0.0.1:15007"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("whitebox: got %v, want %v", env, want)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for script, want := range map[string]int{
+		"exit 0":        0,
+		"exit 3":        3,
+		"kill -TERM $$": 143,
+		"kill -KILL $$": 137,
+	} {
+		cmd := exec.Command("/bin/sh", "-c", script)
+		cmd.Run()
+		if got := exitCode(cmd.ProcessState); got != want {
+			t.Errorf("%s: got %d, want %d", script, got, want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/hbone"
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/certs"
+)
+
+// certRenewer is set if the launcher manages the certificates.
+var certRenewer *certs.Renewer
+
+// authMutex guards auth.Cert, which is replaced on renewal while the admin server, H2R and the hbone
+// handshakes read it.
+var authMutex sync.RWMutex
+
+// meshTLSConfig is the hbone mTLS config with the locked certificate callbacks installed.
+var meshTLSConfig *tls.Config
+
+// setKeys replaces the workload certificate.
+func setKeys(auth *hbone.Auth, priv []byte, chain []string) error {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	if err := auth.SetKeysPEM(priv, chain); err != nil {
+		return err
+	}
+	// hbone terminates the mTLS streams with MeshTLSConfig, reading auth.Cert directly - the certificate
+	// is returned under the read lock instead. Installed once, before the config is used by hbone.
+	if c := auth.MeshTLSConfig; c != nil && c != meshTLSConfig {
+		c.Certificates = nil
+		c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return workloadCert(auth), nil
+		}
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return workloadCert(auth), nil
+		}
+		meshTLSConfig = c
+	}
+	return nil
+}
+
+// workloadCert returns the current workload certificate.
+func workloadCert(auth *hbone.Auth) *tls.Certificate {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return auth.Cert
+}
+
+// InitAuth returns the mesh certificates.
+//
+// If CA_ADDR is set, the launcher creates the key and gets the cert from the
+// CA provider - "meshca", "cas", "istiod", "vault", "local" or a provider://target address.
+// A comma separated list of CAs is tried in order.
+// Otherwise the certs created by the agent are used, with fallback to the
+// default CA for the mesh if the agent is not running.
+//
+// If pc is set, there is no token source and Istiod is authenticated with the provisioning cert.
+// If kp is set, the keys saved on disk are encrypted.
+func InitAuth(ctx context.Context, kr *mesh.KRun, pc *certs.ProvCert, kp ca.KeyProtector) (*hbone.Auth, error) {
+	caAddr := os.Getenv("CA_ADDR")
+	if pc != nil {
+		return initAuthFromCA(ctx, kr, caAddr, pc, kp)
+	}
+	if caAddr == "" {
+		auth, err := authFromDir(kp)
+		if err == nil {
+			return auth, nil
+		}
+		certsLog.Info("Agent certificates not found, using launcher CA client", "error", err)
+	}
+	return initAuthFromCA(ctx, kr, caAddr, nil, kp)
+}
+
+// authFromDir loads the certs saved by the agent or certtool. With a key-encryption-key, the key
+// is decrypted - the certs are loaded from the workload or Istio cert dir.
+func authFromDir(kp ca.KeyProtector) (*hbone.Auth, error) {
+	if kp == nil {
+		return hbone.NewAuthFromDir("")
+	}
+	var err error
+	for _, dir := range []string{certs.WorkloadCertDir, certs.IstioCertDir} {
+		var priv []byte
+		var chain []string
+		var roots string
+		priv, chain, roots, err = certs.LoadCerts(dir, kp)
+		if err != nil {
+			continue
+		}
+		auth := &hbone.Auth{TrustedCertPool: x509.NewCertPool()}
+		auth.AddRoots([]byte(roots))
+		return auth, auth.SetKeysPEM(priv, chain)
+	}
+	return nil, err
+}
+
+// initProvCert loads the provisioning cert and sets the workload identity. CA_ADDR must be the
+// Istiod address, since there is no mesh-env.
+func initProvCert(kr *mesh.KRun, dir string, kp ca.KeyProtector) (*certs.ProvCert, error) {
+	name, target := ca.ParseAddr(kr, os.Getenv("CA_ADDR"))
+	if name != "istiod" || target == "" {
+		return nil, errors.New("provisioning cert requires CA_ADDR=istiod://HOST:15012")
+	}
+	pc, err := certs.LoadProvCert(dir, kp)
+	if err != nil {
+		return nil, err
+	}
+	if err = pc.SetIdentity(kr); err != nil {
+		return nil, err
+	}
+	certsLog.Info("Provisioning cert loaded", "id", pc.SpiffeID, "notAfter", pc.NotAfter)
+	return pc, nil
+}
+
+// initAuthFromCA generates the key and signs it with the CA, refreshing the
+// cert in background. If OUTPUT_CERTS is set, the certs are also saved, for
+// proxyless gRPC or apps using the workload certs.
+func initAuthFromCA(ctx context.Context, kr *mesh.KRun, caAddr string, pc *certs.ProvCert, kp ca.KeyProtector) (*hbone.Auth, error) {
+	timeout, err := durationEnv("CA_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	retry := &ca.RetryPolicy{Timeout: timeout}
+	if v := os.Getenv("CA_ATTEMPTS"); v != "" {
+		retry.MaxAttempts, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA_ATTEMPTS %v", err)
+		}
+	}
+	caOpts := &ca.Options{Retry: retry, KeyProtector: kp}
+	if pc != nil {
+		caOpts.ProvCert = pc.Dir
+		caOpts.TrustedRoots = pc.Roots
+	}
+	signer, err := ca.New(ctx, kr, caAddr, caOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, csr, err := ca.NewCSR(os.Getenv("KEY_TYPE"), kr.TrustDomain, ca.SpiffeID(kr))
+	if err != nil {
+		return nil, err
+	}
+
+	// Roots from mesh-env, the provisioning cert and the CA are merged.
+	src := caAddr
+	if src == "" {
+		src = "mesh"
+	}
+	bundle := &certs.TrustBundle{}
+	if kr.CitadelRoot != "" {
+		if err := bundle.Add("mesh-env", kr.CitadelRoot); err != nil {
+			certsLog.Warn("Invalid mesh-env root", "error", err)
+		}
+	}
+	if pc != nil && pc.RootsPEM != "" {
+		if err := bundle.Add("provisioning", pc.RootsPEM); err != nil {
+			certsLog.Warn("Invalid provisioning cert root", "error", err)
+		}
+	}
+	if rp, ok := signer.(ca.RootProvider); ok {
+		roots, err := rp.GetRootCertBundle(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range roots {
+			if err := bundle.Add(src, r); err != nil {
+				certsLog.Warn("Invalid CA root", "addr", src, "error", err)
+			}
+		}
+	}
+	auth := &hbone.Auth{TrustedCertPool: bundle.Pool()}
+	var save certs.Writer
+	if outDir := os.Getenv("OUTPUT_CERTS"); outDir != "" {
+		save, err = certs.NewWriter("workload", &certs.WriterOptions{Dir: outDir, KeyProtector: kp})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &certs.Renewer{
+		Signer:  signer,
+		PrivPEM: priv,
+		CSR:     csr,
+		TTL:     24 * time.Hour,
+		OnCert: func(priv []byte, chain []string) error {
+			// The tail of the chain is trusted only if it is a root - intermediates are not.
+			n := bundle.Len()
+			if tail := chain[len(chain)-1]; certs.IsSelfSigned(tail) {
+				if err := bundle.Add(src, tail); err != nil {
+					return err
+				}
+			}
+			if bundle.Len() == 0 {
+				return fmt.Errorf("no trust roots for the chain signed by %s", src)
+			}
+			if bundle.Len() != n {
+				authMutex.Lock()
+				auth.TrustedCertPool = bundle.Pool()
+				authMutex.Unlock()
+			}
+			err := setKeys(auth, priv, chain)
+			if err != nil {
+				return err
+			}
+			if save == nil {
+				return nil
+			}
+			return save(priv, chain, bundle.PEM())
+		},
+	}
+	next, err := r.Renew(ctx)
+	if err != nil {
+		return nil, err
+	}
+	certsLog.Info("Mesh certificate provisioned", "nextRenewal", next)
+
+	certRenewer = r
+	go r.Run(ctx)
+
+	return auth, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/hbone"
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/certs"
+)
+
+// leafOnly is a CA that returns only the workload cert and doesn't publish roots.
+type leafOnly struct {
+	s ca.Signer
+}
+
+func (l *leafOnly) CSRSign(ctx context.Context, csrPEM []byte, ttl int64) ([]string, error) {
+	chain, err := l.s.CSRSign(ctx, csrPEM, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return chain[:1], nil
+}
+
+func TestInitAuthRoots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caDir, _ := ioutil.TempDir("", "krun-ca")
+	defer os.RemoveAll(caDir)
+	outDir, _ := ioutil.TempDir("", "krun-certs")
+	defer os.RemoveAll(outDir)
+	os.Setenv("OUTPUT_CERTS", outDir)
+	defer os.Unsetenv("OUTPUT_CERTS")
+
+	kr := mesh.New()
+	kr.TrustDomain, kr.Namespace, kr.KSA = "cluster.local", "test", "default"
+	local, err := ca.NewLocalCA(caDir, kr.TrustDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, _ := local.GetRootCertBundle(ctx)
+
+	auth, err := initAuthFromCA(ctx, kr, "local://"+caDir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workloadCert(auth) == nil {
+		t.Fatal("no workload cert")
+	}
+	_, _, saved, err := certs.LoadCerts(outDir, nil)
+	if err != nil || strings.TrimSpace(saved) != strings.TrimSpace(roots[0]) {
+		t.Errorf("unexpected saved roots %v %q", err, saved)
+	}
+
+	// The tail of the chain is not a root, and the CA doesn't publish roots.
+	ca.Register("leafonly", func(ctx context.Context, kr *mesh.KRun, target string, opts *ca.Options) (ca.Signer, error) {
+		return &leafOnly{s: local}, nil
+	})
+	if _, err = initAuthFromCA(ctx, kr, "leafonly", nil, nil); err == nil || !strings.Contains(err.Error(), "no trust roots") {
+		t.Errorf("intermediate accepted as root: %v", err)
+	}
+
+	// A root from mesh-env is used.
+	kr.CitadelRoot = roots[0]
+	if _, err = initAuthFromCA(ctx, kr, "leafonly", nil, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetKeysHandshakeCert(t *testing.T) {
+	ctx := context.Background()
+	caDir, _ := ioutil.TempDir("", "krun-ca")
+	defer os.RemoveAll(caDir)
+	local, err := ca.NewLocalCA(caDir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renew := func(auth *hbone.Auth) error {
+		priv, csr, err := ca.NewCSR(ca.KeyECDSAP256, "cluster.local", "spiffe://cluster.local/ns/test/sa/default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := local.CSRSign(ctx, csr, 3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return setKeys(auth, priv, chain)
+	}
+
+	auth := &hbone.Auth{}
+	if err := renew(auth); err != nil {
+		t.Fatal(err)
+	}
+	if auth.MeshTLSConfig == nil || auth.MeshTLSConfig.GetCertificate == nil {
+		t.Fatal("certificate callback not installed")
+	}
+
+	// Handshakes get the certificate while it is renewed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if c, _ := auth.MeshTLSConfig.GetCertificate(&tls.ClientHelloInfo{}); c == nil {
+				t.Error("no certificate")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if err := renew(auth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	c, _ := auth.MeshTLSConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if c != workloadCert(auth) {
+		t.Error("handshake doesn't use the renewed certificate")
+	}
+}
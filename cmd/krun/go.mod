@@ -4,11 +4,18 @@ go 1.16
 
 replace github.com/costinm/krun => ../..
 
+replace github.com/costinm/krun/third_party => ../../third_party
+
 //replace github.com/costinm/cert-ssh => ../../../cert-ssh
 
 require (
 	github.com/costinm/hbone v0.0.0-20211014182100-e32b869e6c4b
 	github.com/costinm/krun v0.0.0-00010101000000-000000000000
+	golang.org/x/net v0.30.0
+	google.golang.org/grpc v1.41.0
 )
 
-require github.com/GoogleCloudPlatform/cloud-run-mesh v0.0.0-20211221010907-547059a93d07
+require (
+	github.com/GoogleCloudPlatform/cloud-run-mesh v0.0.0-20220128230121-cac57262761b
+	github.com/costinm/ugate v0.0.0-20220614135442-cafcfb6d0da4
+)
@@ -0,0 +1,352 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/costinm/hbone"
+)
+
+// H2R tunnel states.
+const (
+	H2RConnecting = "connecting"
+	H2RConnected  = "connected"
+	H2RBackoff    = "backoff"
+	H2RStopped    = "stopped"
+)
+
+// H2RTunnel is a persistent reverse tunnel to a mesh connector (hgate).
+//
+// krun dials the connector using mTLS, with the SNI of the service, and acts as HTTP/2 server on the
+// connection - the connector forwards the mesh requests for the SNI. The tunnel is re-established with
+// exponential backoff and jitter. Dead connections are detected by the HTTP/2 server, using pings.
+type H2RTunnel struct {
+	// Addr of the connector, host:port
+	Addr string
+	SNI  string
+
+	Auth *hbone.Auth
+
+	// Peers are the accepted connector identities (URI SANs).
+	Peers []string
+
+	// Serve handles the HTTP/2 connection, blocking until it is closed.
+	Serve func(net.Conn)
+
+	// Draining returns true when krun is shutting down - the tunnel is not re-established.
+	Draining func() bool
+
+	// MinBackoff and MaxBackoff for reconnects. Defaults 1s and 60s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	m              sync.RWMutex
+	state          string
+	connects       int
+	failures       int
+	lastError      string
+	connectedSince time.Time
+	conn           *meteredConn
+}
+
+// H2RStatus is the state and metrics of a tunnel.
+type H2RStatus struct {
+	Addr           string    `json:"addr"`
+	SNI            string    `json:"sni"`
+	State          string    `json:"state"`
+	Connects       int       `json:"connects"`
+	Failures       int       `json:"failures"`
+	LastError      string    `json:"lastError,omitempty"`
+	ConnectedSince time.Time `json:"connectedSince,omitempty"`
+	LastRead       time.Time `json:"lastRead,omitempty"`
+	BytesIn        int64     `json:"bytesIn"`
+	BytesOut       int64     `json:"bytesOut"`
+}
+
+var (
+	h2rMutex   sync.Mutex
+	h2rTunnels []*H2RTunnel
+)
+
+// H2RAddrs returns the connector addresses - MESH_CONNECTORS, a comma separated list of host[:port],
+// defaulting to the mesh connector found in mesh-env. Default port is 15441.
+func H2RAddrs(def string) []string {
+	res := []string{}
+	addrs := os.Getenv("MESH_CONNECTORS")
+	if addrs == "" {
+		addrs = def
+	}
+	for _, a := range strings.Split(addrs, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "15441")
+		}
+		res = append(res, a)
+	}
+	return res
+}
+
+// NewH2RTunnel creates a tunnel and registers it for status reporting.
+func NewH2RTunnel(addr, sni string, auth *hbone.Auth, peers []string, serve func(net.Conn)) *H2RTunnel {
+	t := &H2RTunnel{
+		Addr:       addr,
+		SNI:        sni,
+		Auth:       auth,
+		Peers:      peers,
+		Serve:      serve,
+		MinBackoff: 1 * time.Second,
+		MaxBackoff: 60 * time.Second,
+		state:      H2RConnecting,
+	}
+	h2rMutex.Lock()
+	h2rTunnels = append(h2rTunnels, t)
+	h2rMutex.Unlock()
+	return t
+}
+
+// H2RStatusAll returns the status of all tunnels.
+func H2RStatusAll() []H2RStatus {
+	h2rMutex.Lock()
+	defer h2rMutex.Unlock()
+	res := []H2RStatus{}
+	for _, t := range h2rTunnels {
+		res = append(res, t.Status())
+	}
+	return res
+}
+
+// Run keeps the tunnel connected until ctx is done.
+func (t *H2RTunnel) Run(ctx context.Context) error {
+	backoff := t.MinBackoff
+	for {
+		if t.Draining != nil && t.Draining() {
+			t.setState(H2RStopped, nil)
+			<-ctx.Done()
+			return nil
+		}
+		t.setState(H2RConnecting, nil)
+		start := time.Now()
+		err := t.connectAndServe(ctx)
+		if ctx.Err() != nil {
+			t.setState(H2RStopped, nil)
+			return nil
+		}
+		if t.Draining != nil && t.Draining() {
+			// Closed after GOAWAY and the in-flight streams.
+			continue
+		}
+		// A tunnel that was up for a while resets the backoff.
+		if time.Since(start) > t.MaxBackoff {
+			backoff = t.MinBackoff
+		}
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		t.m.Lock()
+		t.failures++
+		t.m.Unlock()
+		t.setState(H2RBackoff, err)
+
+		// +/- 20% jitter
+		d := backoff + time.Duration(rand.Int63n(int64(backoff)/5*2+1)) - backoff/5
+		h2rLog.Warn("H2R disconnected", "addr", t.Addr, "sni", t.SNI, "error", err, "reconnect", d)
+		select {
+		case <-ctx.Done():
+			t.setState(H2RStopped, nil)
+			return nil
+		case <-time.After(d):
+		}
+		backoff = backoff * 2
+		if backoff > t.MaxBackoff {
+			backoff = t.MaxBackoff
+		}
+	}
+}
+
+func (t *H2RTunnel) connectAndServe(ctx context.Context) error {
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 15 * time.Second},
+		Config: &tls.Config{
+			ServerName: t.SNI,
+			RootCAs:    t.Auth.TrustedCertPool,
+			NextProtos: []string{"h2r", "h2"},
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return workloadCert(t.Auth), nil
+			},
+			// The SNI is the routing key, the connector is identified by the SPIFFE ID in its mesh cert -
+			// verified in VerifyConnection instead of the hostname check.
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				return verifyMeshPeer(t.Auth, t.Peers, cs)
+			},
+		},
+	}
+	c, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return err
+	}
+
+	mc := &meteredConn{Conn: c, lastRead: time.Now().UnixNano()}
+
+	t.m.Lock()
+	t.connects++
+	t.conn = mc
+	t.connectedSince = time.Now()
+	t.m.Unlock()
+	t.setState(H2RConnected, nil)
+	h2rLog.Info("H2R connected", "addr", t.Addr, "sni", t.SNI)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mc.Close()
+		case <-done:
+		}
+	}()
+	t.Serve(mc)
+	close(done)
+	mc.Close()
+
+	t.m.Lock()
+	t.conn = nil
+	t.m.Unlock()
+	return nil
+}
+
+func (t *H2RTunnel) setState(state string, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.state = state
+	if err != nil {
+		t.lastError = err.Error()
+	}
+}
+
+// Status returns the tunnel state and metrics.
+func (t *H2RTunnel) Status() H2RStatus {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	st := H2RStatus{
+		Addr:      t.Addr,
+		SNI:       t.SNI,
+		State:     t.state,
+		Connects:  t.connects,
+		Failures:  t.failures,
+		LastError: t.lastError,
+	}
+	if t.conn != nil {
+		st.ConnectedSince = t.connectedSince
+		st.LastRead = time.Unix(0, atomic.LoadInt64(&t.conn.lastRead))
+		st.BytesIn = atomic.LoadInt64(&t.conn.bytesIn)
+		st.BytesOut = atomic.LoadInt64(&t.conn.bytesOut)
+	}
+	return st
+}
+
+// H2RPeers returns the expected connector identities - MESH_CONNECTOR_SAN, a comma separated list of
+// SPIFFE IDs, or the SPIFFE ID of MESH_CONNECTOR_KSA (namespace/serviceaccount) in the mesh trust domain.
+// There is no default - accepting an arbitrary mesh identity as connector would let any workload intercept
+// the forwarded requests.
+func H2RPeers(trustDomain string) ([]string, error) {
+	res := []string{}
+	for _, san := range strings.Split(os.Getenv("MESH_CONNECTOR_SAN"), ",") {
+		if san = strings.TrimSpace(san); san != "" {
+			res = append(res, san)
+		}
+	}
+	if len(res) > 0 {
+		return res, nil
+	}
+	ksa := os.Getenv("MESH_CONNECTOR_KSA")
+	if ksa == "" {
+		return nil, errors.New("MESH_CONNECTOR_SAN or MESH_CONNECTOR_KSA is required for H2R")
+	}
+	parts := strings.Split(ksa, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid MESH_CONNECTOR_KSA %q, expecting namespace/serviceaccount", ksa)
+	}
+	if trustDomain == "" {
+		trustDomain = "cluster.local"
+	}
+	return []string{"spiffe://" + trustDomain + "/ns/" + parts[0] + "/sa/" + parts[1]}, nil
+}
+
+// verifyMeshPeer checks the connector certificate against the mesh roots, and that it is a server
+// certificate for one of the expected identities.
+func verifyMeshPeer(auth *hbone.Auth, peers []string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("connector did not present a certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         auth.TrustedCertPool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	leaf := cs.PeerCertificates[0]
+	if _, err := leaf.Verify(opts); err != nil {
+		return err
+	}
+	for _, u := range leaf.URIs {
+		for _, p := range peers {
+			if u.String() == p {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unexpected connector identity %v, expecting %v", leaf.URIs, peers)
+}
+
+// meteredConn tracks the activity on a connection.
+type meteredConn struct {
+	net.Conn
+
+	lastRead int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+func (mc *meteredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&mc.lastRead, time.Now().UnixNano())
+		atomic.AddInt64(&mc.bytesIn, int64(n))
+	}
+	return n, err
+}
+
+func (mc *meteredConn) Write(b []byte) (int, error) {
+	n, err := mc.Conn.Write(b)
+	atomic.AddInt64(&mc.bytesOut, int64(n))
+	return n, err
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/costinm/hbone"
+)
+
+const connectorSAN = "spiffe://cluster.local/ns/istio-system/sa/default"
+
+func TestVerifyMeshPeer(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"cluster.local"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	auth := &hbone.Auth{TrustedCertPool: pool}
+
+	leaf := func(san string, eku x509.ExtKeyUsage) tls.ConnectionState {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		u, _ := url.Parse(san)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{eku},
+			URIs:         []*url.URL{u},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &k.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := x509.ParseCertificate(der)
+		return tls.ConnectionState{PeerCertificates: []*x509.Certificate{c}}
+	}
+
+	peers := []string{connectorSAN}
+	if err := verifyMeshPeer(auth, peers, leaf(connectorSAN, x509.ExtKeyUsageServerAuth)); err != nil {
+		t.Error("expected connector rejected", err)
+	}
+	if err := verifyMeshPeer(auth, peers, leaf("spiffe://cluster.local/ns/default/sa/app", x509.ExtKeyUsageServerAuth)); err == nil {
+		t.Error("workload accepted as connector")
+	}
+	if err := verifyMeshPeer(auth, peers, leaf(connectorSAN, x509.ExtKeyUsageClientAuth)); err == nil {
+		t.Error("client cert accepted as connector")
+	}
+	if err := verifyMeshPeer(auth, peers, tls.ConnectionState{}); err == nil {
+		t.Error("missing cert accepted")
+	}
+}
+
+func TestH2RPeers(t *testing.T) {
+	os.Unsetenv("MESH_CONNECTOR_SAN")
+	os.Unsetenv("MESH_CONNECTOR_KSA")
+	if got, err := H2RPeers(""); err == nil {
+		t.Errorf("no connector identity configured: got %v", got)
+	}
+
+	os.Setenv("MESH_CONNECTOR_KSA", "istio-system/default")
+	defer os.Unsetenv("MESH_CONNECTOR_KSA")
+	if got, err := H2RPeers(""); err != nil || !reflect.DeepEqual(got, []string{connectorSAN}) {
+		t.Errorf("ksa: got %v %v", got, err)
+	}
+	for _, ksa := range []string{"default", "istio-system/", "a/b/c"} {
+		os.Setenv("MESH_CONNECTOR_KSA", ksa)
+		if got, err := H2RPeers("td"); err == nil {
+			t.Errorf("invalid ksa %q: got %v", ksa, got)
+		}
+	}
+
+	os.Setenv("MESH_CONNECTOR_SAN", "spiffe://td/ns/a/sa/b, spiffe://td/ns/c/sa/d")
+	defer os.Unsetenv("MESH_CONNECTOR_SAN")
+	if got, err := H2RPeers("td"); err != nil || !reflect.DeepEqual(got, []string{"spiffe://td/ns/a/sa/b", "spiffe://td/ns/c/sa/d"}) {
+		t.Errorf("env: got %v %v", got, err)
+	}
+}
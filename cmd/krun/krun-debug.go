@@ -15,6 +15,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/sshd"
 )
 
@@ -26,5 +31,41 @@ import (
 // on distroless)
 //
 func init() {
-	initDebug = sshd.InitDebug
+	initDebug = runSSHD
+}
+
+// runSSHD starts the upstream debug SSHD - the in-process server or /usr/sbin/sshd if installed - using the
+// 'sshdebug' secret. The server runs until krun exits.
+// Returns ErrDisabled if the secret is missing or has no authorized keys or SSH CA.
+func runSSHD(ctx context.Context, kr *mesh.KRun) error {
+	sshCM, err := kr.Cfg.GetSecret(ctx, kr.Namespace, "sshdebug")
+	if err != nil {
+		logger.Info("SSH debug disabled, missing sshdebug secret", "error", err)
+		return ErrDisabled
+	}
+	if !sshdConfigured(sshCM) {
+		logger.Info("SSH debug disabled, no authorized keys")
+		return ErrDisabled
+	}
+
+	sshd.InitDebug(kr)
+	<-ctx.Done()
+	return nil
+}
+
+// sshdConfigured returns true if InitDebug will start a server for the secret. The system sshd uses the
+// files in the secret, the in-process server requires authorized keys or a SSH CA.
+func sshdConfigured(sshCM map[string][]byte) bool {
+	if _, err := os.Stat("/usr/sbin/sshd"); err == nil {
+		return true
+	}
+	if sshCM["SSHCA_ADDR"] != nil || os.Getenv("SSH_AUTH") != "" {
+		return true
+	}
+	for k := range sshCM {
+		if strings.HasPrefix(k, "authorized_key_") {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,45 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSSHDConfigured(t *testing.T) {
+	if _, err := os.Stat("/usr/sbin/sshd"); err == nil {
+		t.Skip("system sshd installed")
+	}
+	os.Unsetenv("SSH_AUTH")
+	for name, tc := range map[string]struct {
+		secret map[string][]byte
+		want   bool
+	}{
+		"empty":   {map[string][]byte{"id_ecdsa": []byte("key")}, false},
+		"authkey": {map[string][]byte{"authorized_key_admin": []byte("ssh-ed25519 AAAA")}, true},
+		"sshca":   {map[string][]byte{"SSHCA_ADDR": []byte("sshca:443")}, true},
+	} {
+		if got := sshdConfigured(tc.secret); got != tc.want {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+
+	os.Setenv("SSH_AUTH", "ssh-ed25519 AAAA")
+	defer os.Unsetenv("SSH_AUTH")
+	if !sshdConfigured(nil) {
+		t.Error("SSH_AUTH ignored")
+	}
+}
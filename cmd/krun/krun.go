@@ -16,22 +16,45 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
 	"github.com/costinm/hbone"
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/certs"
+	"github.com/costinm/krun/pkg/logs"
 	"github.com/costinm/ugate/urest"
+	"golang.org/x/net/http2"
 )
 
-var initDebug func(run *mesh.KRun)
+// initDebug runs the debug SSHD until ctx is done. Set if the sshd dependency is compiled in.
+var initDebug func(ctx context.Context, kr *mesh.KRun) error
+
+// Loggers for the krun components. The level is set with LOG_LEVEL.
+var (
+	logger   = logs.New("krun")
+	appLog   = logs.New("app")
+	certsLog = logs.New("certs")
+	hboneLog = logs.New("hbone")
+	h2rLog   = logs.New("h2r")
+	supLog   = logs.New("supervisor")
+)
 
 func main() {
 	ctx, cf := context.WithCancel(context.Background())
 	defer cf()
 
+	// Libraries using the standard logger are also logged as JSON.
+	logs.StdLog(logger)
+
 	kr := mesh.New()
 
 	_, err := urest.K8SClient(ctx, &urest.MeshSettings{
@@ -41,75 +64,319 @@ func main() {
 		Location:       kr.ClusterLocation,
 	})
 
+	// Private keys on disk are encrypted if a key-encryption-key is configured.
+	kp, err := ca.NewKeyProtector(os.Getenv("KEY_ENCRYPTION_KEY"))
+	if err != nil {
+		logger.Fatal("Failed to load key-encryption-key", "error", err)
+	}
+
 	// Load mesh-env and other configs from k8s.
+	// Without K8S or GCP, a provisioning cert can be used to get the certs from Istiod.
+	var provCert *certs.ProvCert
 	err = kr.LoadConfig(context.Background())
+	if err != nil && os.Getenv("PROV_CERT") != "" {
+		logger.Info("No K8S or GCP token source, using provisioning cert", "dir", os.Getenv("PROV_CERT"), "error", err)
+		provCert, err = initProvCert(kr, os.Getenv("PROV_CERT"), kp)
+	}
 	if err != nil {
-		log.Fatal("Failed to connect to mesh ", time.Since(kr.StartTime), kr, os.Environ(), err)
+		logger.Fatal("Failed to connect to mesh", "elapsed", time.Since(kr.StartTime), "project", kr.ProjectId,
+			"location", kr.ClusterLocation, "cluster", kr.ClusterName, "namespace", kr.Namespace, "error", err)
 	}
 
-	log.Println("K8S Client initialized", kr.ProjectId, kr.ClusterLocation, kr.ClusterName, kr.ProjectNumber,
-		kr.KSA, kr.Namespace, kr.Name, kr.Labels, kr.XDSAddr)
+	logger.Info("K8S Client initialized", "project", kr.ProjectId, "location", kr.ClusterLocation,
+		"cluster", kr.ClusterName, "projectNumber", kr.ProjectNumber, "ksa", kr.KSA, "namespace", kr.Namespace,
+		"name", kr.Name, "labels", kr.Labels, "xds", kr.XDSAddr)
 
 	// End initialization - start the app and istio
 
 	err = kr.WaitEnvoyReady("127.0.0.1:15000", 10*time.Second)
 	if err != nil {
-		log.Fatal("MeshSettings agent not ready ", err)
+		logger.Fatal("MeshSettings agent not ready", "error", err)
 	}
 
-	kr.StartApp()
+	readyCheck, err := ReadyCheckFromEnv()
+	if err != nil {
+		logger.Fatal("Invalid app readiness check", "error", err)
+	}
+	ports, err := PortsFromEnv(kr)
+	if err != nil {
+		logger.Fatal("Invalid MESH_PORTS", "error", err)
+	}
+	grace, err := durationEnv("SHUTDOWN_GRACE")
+	if err != nil || grace == 0 {
+		grace = 8 * time.Second
+	}
+
+	app, err := StartApp(kr, os.Args[1:])
+	if err != nil {
+		logger.Fatal("Failed to start app", "error", err)
+	}
+
+	// Subsystems are restarted with backoff if they fail. Health is reported on the local status endpoint.
+	sup := NewSupervisor()
+	compCtx, stopComponents := context.WithCancel(ctx)
+
+	// From here on, the signals and the app exit are handled by sd - failures must terminate the app.
+	sd := NewShutdown(app, grace)
+	sd.Stop = stopComponents
+	sd.Fatal = sup.Fatal()
+	sd.EnvoyAdmin = "127.0.0.1:15000"
+	go sd.Run()
 
-	// TODO: wait for app  ready before binding to port - using same CloudRun 'bind to port 8080' or proper health check
+	admin := NewAdmin(sup)
+	admin.KRun = kr
+	admin.App = app
+	admin.Ready = readyCheck
+	admin.EnvoyAdmin = "127.0.0.1:15000"
+	sup.Go(compCtx, &Component{Name: "admin", MaxFailures: 3, Run: admin.Run})
 
 	// Start internal SSH server, for debug and port forwarding. Can be conditionally compiled.
 	if initDebug != nil {
 		// Split for conditional compilation (to compile without ssh dep)
-		go initDebug(kr)
+		sup.Go(compCtx, &Component{Name: "sshd", MaxFailures: 3, Run: func(ctx context.Context) error {
+			return initDebug(ctx, kr)
+		}})
 	}
 
 	// Start the tunnel: accepts H2 streams, decrypt the stream as mTLS, forward plain text to 15003 (envoy) which
 	// applies the metrics/enforcements and forwards to the app on 8080
-	// The certs are currently created by agent - WIP to create them from launcher, so proxyless gRPC doesn't require pilot-agent.
-	auth, err := hbone.NewAuthFromDir("")
+	// The certs are created by agent, or by the launcher if CA_ADDR is set or the agent is not running - so
+	// proxyless gRPC doesn't require pilot-agent.
+	auth, err := InitAuth(ctx, kr, provCert, kp)
 	if err != nil {
-		log.Fatal("Failed to find mesh certificates ", err)
+		sd.Abort(fmt.Errorf("failed to find mesh certificates: %v", err))
 	}
+	admin.SetAuth(auth)
 
-	hb, err := InitHBone(auth)
-	if err != nil {
+	// Wait for app ready before binding to port - CloudRun routes traffic as soon as the port is open.
+	if readyCheck != nil && app != nil {
+		err = readyCheck.Wait(ctx, app.Done())
+		if err == errAppExited {
+			// sd exits with the app exit code.
+			select {}
+		}
+		if err != nil {
+			sd.Abort(err)
+		}
+		logger.Info("App ready", "elapsed", time.Since(kr.StartTime))
 	}
 
+	hb := InitHBone(auth, ports)
+	admin.SetHBone(hb)
+	sd.SetHBone(hb)
+	sup.Go(compCtx, &Component{Name: "hbone", Critical: true, MaxFailures: 5, Run: hb.Run})
+
 	if os.Getenv("H2R") != "" && kr.MeshConnectorAddr != "" {
-		InitHBoneR(hb, kr.Name, kr.Namespace, kr.MeshConnectorAddr)
+		addrs := H2RAddrs(kr.MeshConnectorAddr)
+		peers, err := H2RPeers(kr.TrustDomain)
+		if err != nil {
+			logger.Error("H2R disabled", "error", err)
+		} else {
+			for _, c := range InitHBoneR(hb, auth, kr.Name, kr.Namespace, addrs, peers, ports) {
+				sup.Go(compCtx, c)
+			}
+		}
 	}
 
+	// sd.Run exits the process.
 	select {}
 }
 
-func InitHBone(auth *hbone.Auth) (*hbone.HBone, error) {
+// HBoneServer is the HBONE listener, tracking the active streams for draining.
+type HBoneServer struct {
+	*hbone.HBone
+
+	// Handler for the HBONE streams - hbone or the port mux.
+	Handler http.Handler
+
+	h2s *http2.Server
+	// h1 is only used to send GOAWAY on the HTTP/2 connections - including H2R - on shutdown.
+	h1 *http.Server
+
+	draining int32
+	count    int64
+	accepted int64
+	streams  int64
+	total    int64
+}
+
+// Run accepts connections on 15009 until ctx is done. After Shutdown it stops accepting, and
+// waits for ctx.
+func (hs *HBoneServer) Run(ctx context.Context) error {
+	if hs.Draining() {
+		<-ctx.Done()
+		return nil
+	}
+	l, err := net.Listen("tcp", ":15009")
+	if err != nil {
+		return fmt.Errorf("failed to start h2c on 15009 %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		l.Close()
+	}()
+	hs.h1.RegisterOnShutdown(func() {
+		l.Close()
+	})
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if hs.Draining() {
+				<-ctx.Done()
+				return nil
+			}
+			return err
+		}
+		atomic.AddInt64(&hs.count, 1)
+		atomic.AddInt64(&hs.accepted, 1)
+		go func() {
+			defer atomic.AddInt64(&hs.count, -1)
+			hs.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn handles an HTTP/2 connection - accepted on 15009 or an H2R tunnel - until it is closed.
+func (hs *HBoneServer) ServeConn(conn net.Conn) {
+	hs.h2s.ServeConn(conn, &http2.ServeConnOpts{Handler: hs.Handler, BaseConfig: hs.h1})
+}
+
+// Shutdown stops accepting connections and sends GOAWAY on the open connections, which are closed
+// when their active streams are done.
+func (hs *HBoneServer) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&hs.draining, 0, 1) {
+		return
+	}
+	ctx, cf := context.WithTimeout(context.Background(), time.Second)
+	defer cf()
+	hs.h1.Shutdown(ctx)
+}
+
+// Draining returns true after Shutdown.
+func (hs *HBoneServer) Draining() bool {
+	return atomic.LoadInt32(&hs.draining) == 1
+}
+
+// Active returns the number of open HBONE connections.
+func (hs *HBoneServer) Active() int64 {
+	return atomic.LoadInt64(&hs.count)
+}
+
+// HBoneStats are the connection and stream counters, for the admin server.
+type HBoneStats struct {
+	ActiveConnections int64 `json:"activeConnections"`
+	TotalConnections  int64 `json:"totalConnections"`
+	ActiveStreams     int64 `json:"activeStreams"`
+	TotalStreams      int64 `json:"totalStreams"`
+}
+
+// Stats returns the connection and stream counters. Streams include the ones received on H2R tunnels.
+func (hs *HBoneServer) Stats() HBoneStats {
+	return HBoneStats{
+		ActiveConnections: atomic.LoadInt64(&hs.count),
+		TotalConnections:  atomic.LoadInt64(&hs.accepted),
+		ActiveStreams:     atomic.LoadInt64(&hs.streams),
+		TotalStreams:      atomic.LoadInt64(&hs.total),
+	}
+}
+
+// countStreams wraps the stream handler, counting the active and total streams.
+func (hs *HBoneServer) countStreams(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hs.streams, 1)
+		atomic.AddInt64(&hs.total, 1)
+		defer atomic.AddInt64(&hs.streams, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Wait for the active streams to finish, or ctx to be done. HBONE and H2R connections are persistent,
+// only the streams are waited for.
+func (hs *HBoneServer) Wait(ctx context.Context) error {
+	for atomic.LoadInt64(&hs.streams) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// InitHBone creates the HBONE server. Streams for the ports in MESH_PORTS are forwarded to the local port,
+// everything else to envoy.
+func InitHBone(auth *hbone.Auth, ports []*Port) *HBoneServer {
 	// 15009 is the reserved port for HBONE using H2C. CloudRun or other gateways using H2C will forward to this
 	// port.
 	hb := hbone.New(auth)
 	// This is a port on envoy, created by Sidecar or directly by Istiod.
 	// Needs to be plain-text HTTP
 	hb.TcpAddr = "127.0.0.1:15003" // must match sni-service-template port in Sidecar
-	_, err := hbone.ListenAndServeTCP(":15009", hb.HandleAcceptedH2C)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to start h2c on 15009 %v", err)
+
+	// Idle connections - including the H2R attachments - are checked with a ping, and closed if the peer
+	// doesn't answer.
+	hs := &HBoneServer{HBone: hb, h1: &http.Server{}, h2s: &http2.Server{
+		ReadIdleTimeout: 15 * time.Second,
+		PingTimeout:     10 * time.Second,
+	}}
+	h := h2cHandler(hb.HandleAcceptedH2C)
+	if len(ports) > 0 {
+		h = NewPortMux(ports, h)
 	}
-	return hb, nil
+	hs.Handler = hs.countStreams(h)
+	// Registers the connections served with h1 as BaseConfig, for the graceful shutdown.
+	http2.ConfigureServer(hs.h1, hs.h2s)
+	return hs
 }
 
-// Experimental: if hgate east-west gateway present, create a connection.
-func InitHBoneR(hb *hbone.HBone, name, ns, conaddr string) error {
-	hg := conaddr
-	attachC := hb.NewClient(name + "." + ns + ":15009")
-	attachE := attachC.NewEndpoint("")
-	attachE.SNI = fmt.Sprintf("outbound_.8080_._.%s.%s.svc.cluster.local", name, ns)
-	go func() {
-		_, err := attachE.DialH2R(context.Background(), hg+":15441")
-		log.Println("H2R connected", hg, err)
-	}()
+// h2cHandler forwards each stream over in-memory H2C connections, served by serve. Used for hbone - which
+// terminates the mTLS and forwards to envoy - since it only exports the per-connection HandleAcceptedH2C.
+func h2cHandler(serve func(net.Conn)) http.Handler {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = r.Host
+		},
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				c, s := net.Pipe()
+				go serve(s)
+				return c, nil
+			},
+		},
+		// The HBONE streams are tunnels, the data is sent as soon as it is read.
+		FlushInterval: -1,
+	}
+}
 
-	return nil
+// Experimental: if hgate east-west gateway present, create a connection.
+// Returns one component for each connector address and port, registering the port SNI - default is 8080.
+// The connectors must present a mesh certificate for one of the peer identities.
+func InitHBoneR(hs *HBoneServer, auth *hbone.Auth, name, ns string, addrs, peers []string, ports []*Port) []*Component {
+	if len(ports) == 0 {
+		ports = []*Port{{Name: "http", Port: 8080, Protocol: "H1"}}
+	}
+	res := []*Component{}
+	for _, addr := range addrs {
+		for _, p := range ports {
+			sni := fmt.Sprintf("outbound_.%d_._.%s.%s.svc.cluster.local", p.Port, name, ns)
+			t := NewH2RTunnel(addr, sni, auth, peers, hs.ServeConn)
+			t.Draining = hs.Draining
+			res = append(res, &Component{
+				Name: "h2r-" + addr + "-" + strconv.Itoa(p.Port),
+				Run:  t.Run,
+			})
+		}
+	}
+	return res
 }
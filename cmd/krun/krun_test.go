@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2CHandler(t *testing.T) {
+	// The per-connection handler echoes the stream, like a tunnel.
+	serve := func(c net.Conn) {
+		(&http2.Server{}).ServeConn(c, &http2.ServeConnOpts{Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/_hbone/mtls" || r.Host != "svc.ns:8080" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				buf := make([]byte, 1024)
+				for {
+					n, err := r.Body.Read(buf)
+					if n > 0 {
+						w.Write(buf[:n])
+						w.(http.Flusher).Flush()
+					}
+					if err != nil {
+						return
+					}
+				}
+			})})
+	}
+	h := h2cHandler(serve)
+
+	// Client H2C connection to the handler, as on 15009.
+	client := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			c, s := net.Pipe()
+			go (&http2.Server{}).ServeConn(s, &http2.ServeConnOpts{Handler: h})
+			return c, nil
+		},
+	}
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", "http://svc.ns:8080/_hbone/mtls", pr)
+	res, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	// Each line is echoed before the next is sent - the stream is not buffered.
+	br := bufio.NewReader(res.Body)
+	for _, l := range []string{"hello\n", "world\n"} {
+		if _, err := pw.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := br.ReadString('\n')
+		if err != nil || got != l {
+			t.Fatalf("got %q %v, expecting %q", got, err, l)
+		}
+	}
+	pw.Close()
+
+	res, err = client.RoundTrip(&http.Request{Method: "GET", URL: req.URL, Host: "other:8080", Header: http.Header{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("request not forwarded as sent, got %d", res.StatusCode)
+	}
+}
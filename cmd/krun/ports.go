@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"golang.org/x/net/http2"
+)
+
+// Port is a container port exposed to the mesh, local to the container.
+type Port struct {
+	Name string
+	Port int
+	// Protocol is TCP, H1, H2 or GRPC.
+	Protocol string
+
+	proxy http.Handler
+}
+
+// PortsFromEnv parses MESH_PORTS from mesh-env or the environment, in the format NAME:PORT[:PROTOCOL],...
+// For example "http:8080:H1,grpc:9090:GRPC,db:5432". Default protocol is TCP.
+func PortsFromEnv(kr *mesh.KRun) ([]*Port, error) {
+	return ParsePorts(kr.Config("MESH_PORTS", ""))
+}
+
+// ParsePorts parses the MESH_PORTS format.
+func ParsePorts(spec string) ([]*Port, error) {
+	res := []*Port{}
+	for _, ps := range strings.Split(spec, ",") {
+		ps = strings.TrimSpace(ps)
+		if ps == "" {
+			continue
+		}
+		parts := strings.Split(ps, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid port %s, expecting NAME:PORT[:PROTOCOL]", ps)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port number %s", ps)
+		}
+		p := &Port{Name: parts[0], Port: n, Protocol: "TCP"}
+		if len(parts) == 3 {
+			p.Protocol = strings.ToUpper(parts[2])
+		}
+		switch p.Protocol {
+		case "TCP", "H1", "H2", "GRPC":
+		default:
+			return nil, fmt.Errorf("invalid protocol %s, expecting TCP, H1, H2 or GRPC", ps)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// Addr returns the local address of the port.
+func (p *Port) Addr() string {
+	return "127.0.0.1:" + strconv.Itoa(p.Port)
+}
+
+// PortMux routes the accepted HBONE streams to the local ports.
+//
+// - /_hbone/PORT or /_hbone/NAME: the stream is tunneled to the local port.
+// - HTTP requests for an H1, H2 or GRPC port (based on :authority port) are proxied to the port.
+// - Anything else is handled by the default handler - envoy, using the SNI routing.
+type PortMux struct {
+	Ports   []*Port
+	Default http.Handler
+}
+
+func (pm *PortMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/_hbone/") {
+		if p := pm.find(strings.TrimPrefix(r.URL.Path, "/_hbone/")); p != nil {
+			pm.tunnel(p, w, r)
+			return
+		}
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		if p := pm.find(port); p != nil && p.Protocol != "TCP" {
+			p.proxy.ServeHTTP(w, r)
+			return
+		}
+	}
+	pm.Default.ServeHTTP(w, r)
+}
+
+func (pm *PortMux) find(key string) *Port {
+	for _, p := range pm.Ports {
+		if p.Name == key || strconv.Itoa(p.Port) == key {
+			return p
+		}
+	}
+	return nil
+}
+
+// tunnel forwards the request body to the local port, and the response back.
+func (pm *PortMux) tunnel(p *Port, w http.ResponseWriter, r *http.Request) {
+	c, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		hboneLog.Warn("Failed to connect to local port", "port", p.Name, "portNumber", p.Port, "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer c.Close()
+
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	go func() {
+		io.Copy(c, r.Body)
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[0:n]); werr != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// NewPortMux creates the mux, with a reverse proxy for each HTTP port.
+func NewPortMux(ports []*Port, def http.Handler) *PortMux {
+	for _, p := range ports {
+		if p.Protocol == "TCP" {
+			continue
+		}
+		rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: p.Addr()})
+		if p.Protocol == "H2" || p.Protocol == "GRPC" {
+			// h2c to the app
+			rp.Transport = &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					d := net.Dialer{}
+					return d.DialContext(context.Background(), network, addr)
+				},
+			}
+		}
+		p.proxy = rp
+	}
+	return &PortMux{Ports: ports, Default: def}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts(" http:8080:h1, grpc:9090:GRPC,db:5432,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Port{
+		{Name: "http", Port: 8080, Protocol: "H1"},
+		{Name: "grpc", Port: 9090, Protocol: "GRPC"},
+		{Name: "db", Port: 5432, Protocol: "TCP"},
+	}
+	if len(ports) != len(want) {
+		t.Fatalf("got %d ports, want %d", len(ports), len(want))
+	}
+	for i, p := range ports {
+		if p.Name != want[i].Name || p.Port != want[i].Port || p.Protocol != want[i].Protocol {
+			t.Errorf("port %d: got %+v, want %+v", i, *p, want[i])
+		}
+	}
+
+	if ports, err := ParsePorts(""); err != nil || len(ports) != 0 {
+		t.Errorf("empty: got %v %v", ports, err)
+	}
+
+	for _, spec := range []string{"http", "http:x", "http:0", "http:70000", "http:80:UDP", "a:1:H1:x"} {
+		if _, err := ParsePorts(spec); err == nil {
+			t.Errorf("%q: expecting error", spec)
+		}
+	}
+}
+
+func TestPortMuxDefault(t *testing.T) {
+	ports, _ := ParsePorts("http:8080:H1,db:5432")
+	def := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	pm := NewPortMux(ports, def)
+
+	// TCP ports and unknown ports go to envoy.
+	for _, host := range []string{"svc:5432", "svc:9999", "svc"} {
+		w := httptest.NewRecorder()
+		pm.ServeHTTP(w, httptest.NewRequest("GET", "http://"+host+"/", nil))
+		if w.Code != http.StatusTeapot {
+			t.Errorf("%s: got %d, expecting default handler", host, w.Code)
+		}
+	}
+	if pm.find("http") != ports[0] || pm.find("5432") != ports[1] || pm.find("x") != nil {
+		t.Error("find by name or number failed")
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ReadyCheck is a probe for the app readiness, similar with the K8S readiness probes.
+//
+// Configured with APP_READY, in one of the forms:
+// - tcp:PORT or tcp:HOST:PORT - the app accepts connections
+// - http:PORT/PATH - GET returns a 2xx or 3xx status
+// - grpc:PORT or grpc:PORT/SERVICE - the gRPC health service returns SERVING
+// - exec:COMMAND ARGS - the command exits with 0
+// - none - don't wait for the app.
+//
+// The default is tcp:8080, matching CloudRun 'bind to port 8080'.
+type ReadyCheck struct {
+	Type string
+	Addr string
+	Path string
+	Cmd  []string
+
+	// Timeout for each probe. Default 1s, APP_READY_PROBE_TIMEOUT
+	Timeout time.Duration
+
+	// Period between probes. Default 200ms, APP_READY_PERIOD
+	Period time.Duration
+
+	// Retries is the max number of failed probes, 0 for no limit. APP_READY_RETRIES
+	Retries int
+
+	// MaxWait is the max time to wait for the app. Default 4m, APP_READY_TIMEOUT
+	MaxWait time.Duration
+}
+
+// ReadyCheckFromEnv returns the configured check, or nil if the app readiness is not checked.
+func ReadyCheckFromEnv() (*ReadyCheck, error) {
+	spec := os.Getenv("APP_READY")
+	if spec == "" {
+		spec = "tcp:8080"
+	}
+	rc, err := ParseReadyCheck(spec)
+	if err != nil || rc == nil {
+		return rc, err
+	}
+	if d, err := durationEnv("APP_READY_PROBE_TIMEOUT"); err != nil {
+		return nil, err
+	} else if d != 0 {
+		rc.Timeout = d
+	}
+	if d, err := durationEnv("APP_READY_PERIOD"); err != nil {
+		return nil, err
+	} else if d != 0 {
+		rc.Period = d
+	}
+	if d, err := durationEnv("APP_READY_TIMEOUT"); err != nil {
+		return nil, err
+	} else if d != 0 {
+		rc.MaxWait = d
+	}
+	if v := os.Getenv("APP_READY_RETRIES"); v != "" {
+		rc.Retries, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid APP_READY_RETRIES %s: %v", v, err)
+		}
+	}
+	return rc, nil
+}
+
+// ParseReadyCheck parses the APP_READY format.
+func ParseReadyCheck(spec string) (*ReadyCheck, error) {
+	if spec == "none" {
+		return nil, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid readiness check %s", spec)
+	}
+	rc := &ReadyCheck{
+		Type:    parts[0],
+		Timeout: 1 * time.Second,
+		Period:  200 * time.Millisecond,
+		MaxWait: 4 * time.Minute,
+	}
+	target := parts[1]
+	switch rc.Type {
+	case "exec":
+		rc.Cmd = strings.Fields(target)
+		if len(rc.Cmd) == 0 {
+			return nil, fmt.Errorf("invalid readiness check %s", spec)
+		}
+		return rc, nil
+	case "tcp", "http", "grpc":
+	default:
+		return nil, fmt.Errorf("invalid readiness check type %s", rc.Type)
+	}
+	if i := strings.Index(target, "/"); i >= 0 {
+		rc.Path = target[i:]
+		target = target[0:i]
+	}
+	if !strings.Contains(target, ":") {
+		target = "127.0.0.1:" + target
+	}
+	rc.Addr = target
+	return rc, nil
+}
+
+// errAppExited is returned by Wait if the app exits before it is ready.
+var errAppExited = errors.New("app exited before it was ready")
+
+// Wait probes the app until it is ready, the retries are exhausted, MaxWait expires or the app
+// exits - exited is closed.
+func (rc *ReadyCheck) Wait(ctx context.Context, exited <-chan struct{}) error {
+	ctx, cf := context.WithTimeout(ctx, rc.MaxWait)
+	defer cf()
+	failures := 0
+	for {
+		err := rc.Probe(ctx)
+		if err == nil {
+			return nil
+		}
+		failures++
+		if rc.Retries > 0 && failures >= rc.Retries {
+			return fmt.Errorf("app not ready after %d probes: %v", failures, err)
+		}
+		select {
+		case <-exited:
+			return errAppExited
+		case <-ctx.Done():
+			return fmt.Errorf("app not ready after %v: %v", rc.MaxWait, err)
+		case <-time.After(rc.Period):
+		}
+	}
+}
+
+// Probe runs a single check.
+func (rc *ReadyCheck) Probe(ctx context.Context) error {
+	ctx, cf := context.WithTimeout(ctx, rc.Timeout)
+	defer cf()
+
+	switch rc.Type {
+	case "tcp":
+		d := net.Dialer{}
+		c, err := d.DialContext(ctx, "tcp", rc.Addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+rc.Addr+rc.Path, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return fmt.Errorf("status %d", res.StatusCode)
+		}
+		return nil
+	case "grpc":
+		con, err := grpc.DialContext(ctx, rc.Addr, grpc.WithInsecure(), grpc.WithBlock())
+		if err != nil {
+			return err
+		}
+		defer con.Close()
+		res, err := grpc_health_v1.NewHealthClient(con).Check(ctx,
+			&grpc_health_v1.HealthCheckRequest{Service: strings.TrimPrefix(rc.Path, "/")})
+		if err != nil {
+			return err
+		}
+		if res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("status %v", res.Status)
+		}
+		return nil
+	case "exec":
+		return exec.CommandContext(ctx, rc.Cmd[0], rc.Cmd[1:]...).Run()
+	}
+	return errors.New("invalid readiness check type " + rc.Type)
+}
+
+func durationEnv(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s: %v", name, v, err)
+	}
+	return d, nil
+}
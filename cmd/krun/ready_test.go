@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReadyCheck(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want *ReadyCheck
+	}{
+		{"none", nil},
+		{"tcp:8080", &ReadyCheck{Type: "tcp", Addr: "127.0.0.1:8080"}},
+		{"tcp:10.0.0.1:8080", &ReadyCheck{Type: "tcp", Addr: "10.0.0.1:8080"}},
+		{"http:8080/healthz", &ReadyCheck{Type: "http", Addr: "127.0.0.1:8080", Path: "/healthz"}},
+		{"grpc:9090", &ReadyCheck{Type: "grpc", Addr: "127.0.0.1:9090"}},
+		{"grpc:9090/my.Service", &ReadyCheck{Type: "grpc", Addr: "127.0.0.1:9090", Path: "/my.Service"}},
+		{"exec:/bin/check -v", &ReadyCheck{Type: "exec", Cmd: []string{"/bin/check", "-v"}}},
+	} {
+		rc, err := ParseReadyCheck(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		if rc != nil {
+			if rc.Timeout != time.Second || rc.Period != 200*time.Millisecond || rc.MaxWait != 4*time.Minute {
+				t.Errorf("%s: unexpected defaults %+v", tc.spec, rc)
+			}
+			rc.Timeout, rc.Period, rc.MaxWait = 0, 0, 0
+		}
+		if !reflect.DeepEqual(rc, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.spec, rc, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"", "tcp", "tcp:", "udp:53", "exec: "} {
+		if _, err := ParseReadyCheck(spec); err == nil {
+			t.Errorf("%q: expecting error", spec)
+		}
+	}
+}
+
+func TestReadyCheckWait(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	rc, _ := ParseReadyCheck("tcp:" + addr)
+	rc.Period = 10 * time.Millisecond
+
+	t.Run("retries", func(t *testing.T) {
+		rc := *rc
+		rc.Retries = 3
+		if err := rc.Wait(context.Background(), nil); err == nil {
+			t.Error("expecting error with no listener")
+		}
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		exited := make(chan struct{})
+		close(exited)
+		if err := rc.Wait(context.Background(), exited); err != errAppExited {
+			t.Errorf("got %v, want %v", err, errAppExited)
+		}
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Skip("port reused", err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		if err := rc.Wait(context.Background(), nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
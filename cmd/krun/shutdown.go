@@ -0,0 +1,218 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Shutdown handles the signals and the graceful termination of krun.
+//
+// CloudRun sends SIGTERM 10 seconds before killing the instance. On SIGTERM or SIGINT krun stops
+// accepting HBONE connections and sends GOAWAY on the HBONE and H2R connections, drains envoy, and
+// waits for the in-flight streams. The app is signaled after the drain, and has the rest of the grace
+// period to exit. Other signals are forwarded to the app.
+//
+// The signals are handled from the start - including while waiting for the app to be ready.
+type Shutdown struct {
+	App *App
+
+	// Stop the supervised components - called after the drain.
+	Stop func()
+
+	// Fatal receives the failure of a critical component.
+	Fatal <-chan error
+
+	// Grace is the max time to wait for draining and for the app to exit. Default 8s, SHUTDOWN_GRACE
+	Grace time.Duration
+
+	// EnvoyAdmin is the admin address of envoy, empty if envoy is not running.
+	EnvoyAdmin string
+
+	sigs  chan os.Signal
+	abort chan error
+
+	m     sync.Mutex
+	hbone *HBoneServer
+}
+
+// NewShutdown starts handling the termination signals. Run must be called to act on them.
+func NewShutdown(app *App, grace time.Duration) *Shutdown {
+	s := &Shutdown{
+		App:   app,
+		Grace: grace,
+		sigs:  make(chan os.Signal, 1),
+		abort: make(chan error, 1),
+	}
+	signal.Notify(s.sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	return s
+}
+
+// SetHBone sets the HBONE server to drain, once started.
+func (s *Shutdown) SetHBone(hs *HBoneServer) {
+	s.m.Lock()
+	s.hbone = hs
+	s.m.Unlock()
+}
+
+func (s *Shutdown) hb() *HBoneServer {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.hbone
+}
+
+// Abort terminates the app and exits krun with code 1. It does not return.
+func (s *Shutdown) Abort(err error) {
+	s.abort <- err
+	select {}
+}
+
+// Run waits for a termination signal or the app exit, and exits the process with the app exit code.
+// If a critical component fails, or Abort is called, the app is terminated and krun exits with code 1.
+func (s *Shutdown) Run() {
+	var appDone <-chan struct{}
+	if s.App != nil {
+		appDone = s.App.Done()
+	}
+
+	for {
+		select {
+		case <-appDone:
+			// Like a Pod with a single container - the instance is done when the app exits.
+			ctx, cf := context.WithTimeout(context.Background(), s.Grace)
+			s.drain(ctx, false)
+			cf()
+			os.Exit(s.App.ExitCode())
+		case err := <-s.Fatal:
+			logger.Error("Shutdown on fatal error", "error", err)
+			s.terminate(syscall.SIGTERM)
+			os.Exit(1)
+		case err := <-s.abort:
+			logger.Error("Shutdown", "error", err)
+			s.terminate(syscall.SIGTERM)
+			os.Exit(1)
+		case sig := <-s.sigs:
+			if sig != syscall.SIGTERM && sig != os.Interrupt {
+				if s.App != nil {
+					s.App.Signal(sig)
+				}
+				continue
+			}
+			logger.Info("Shutdown on signal", "signal", sig)
+			os.Exit(s.terminate(sig))
+		}
+	}
+}
+
+// terminate drains, then signals the app and waits for it to exit, returning the app exit code.
+// The drain can take up to 3/4 of the grace period, the app has at least the rest.
+func (s *Shutdown) terminate(sig os.Signal) int {
+	ctx, cf := context.WithTimeout(context.Background(), s.Grace)
+	defer cf()
+	dctx, dcf := context.WithTimeout(ctx, s.Grace*3/4)
+	s.drain(dctx, true)
+	dcf()
+	if s.Stop != nil {
+		s.Stop()
+	}
+
+	if s.App == nil {
+		return 0
+	}
+	s.App.Signal(sig)
+	select {
+	case <-s.App.Done():
+	case <-ctx.Done():
+		logger.Warn("App still running after grace period, killing", "grace", s.Grace)
+		s.App.Cmd.Process.Kill()
+		<-s.App.Done()
+	}
+	return s.App.ExitCode()
+}
+
+// drain stops accepting and waits for in-flight requests to finish, or ctx to be done. If wait is false,
+// the active streams are not waited for - the app is gone.
+func (s *Shutdown) drain(ctx context.Context, wait bool) {
+	hs := s.hb()
+	if hs != nil {
+		hs.Shutdown()
+	}
+	if s.EnvoyAdmin != "" {
+		drainEnvoy(ctx, s.EnvoyAdmin)
+	}
+	if !wait {
+		return
+	}
+
+	if hs != nil {
+		if err := hs.Wait(ctx); err != nil {
+			logger.Warn("HBONE streams still active after drain timeout", "streams", hs.Stats().ActiveStreams)
+		}
+	}
+	if s.EnvoyAdmin != "" {
+		waitEnvoyDrained(ctx, s.EnvoyAdmin)
+	}
+}
+
+// adminClient is used for the envoy admin calls - bounded, in case envoy is stuck.
+var adminClient = &http.Client{Timeout: 2 * time.Second}
+
+// drainEnvoy starts the graceful drain of the inbound listeners.
+func drainEnvoy(ctx context.Context, admin string) {
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		"http://"+admin+"/drain_listeners?inboundonly&graceful", nil)
+	if err != nil {
+		return
+	}
+	res, err := adminClient.Do(req)
+	if err != nil {
+		logger.Warn("Failed to drain envoy", "error", err)
+		return
+	}
+	res.Body.Close()
+}
+
+// waitEnvoyDrained waits until envoy has no draining listeners.
+func waitEnvoyDrained(ctx context.Context, admin string) {
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET",
+			"http://"+admin+"/stats?filter=listener_manager.total_listeners_draining", nil)
+		if err != nil {
+			return
+		}
+		res, err := adminClient.Do(req)
+		if err != nil {
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if strings.HasSuffix(strings.TrimSpace(string(body)), ": 0") {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func newTestHBone(h http.Handler) *HBoneServer {
+	hs := &HBoneServer{h2s: &http2.Server{}, h1: &http.Server{}}
+	hs.Handler = hs.countStreams(h)
+	http2.ConfigureServer(hs.h1, hs.h2s)
+	return hs
+}
+
+// An in-flight stream completes after Shutdown, and the persistent connection is closed once it is done.
+func TestHBoneDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	hs := newTestHBone(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	connDone := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		hs.ServeConn(c)
+		close(connDone)
+	}()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, l.Addr().String())
+		},
+	}}
+	body := make(chan string, 1)
+	go func() {
+		res, err := client.Get("http://hbone/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		body <- string(b)
+	}()
+
+	<-started
+	hs.Shutdown()
+	if !hs.Draining() {
+		t.Error("not draining after Shutdown")
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cf()
+	if err := hs.Wait(ctx); err == nil {
+		t.Fatal("Wait returned with an active stream")
+	}
+
+	close(release)
+	ctx, cf = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	if err := hs.Wait(ctx); err != nil {
+		t.Fatal("streams not drained", err)
+	}
+	if b := <-body; b != "done" {
+		t.Error("in-flight stream not completed", b)
+	}
+
+	select {
+	case <-connDone:
+	case <-time.After(5 * time.Second):
+		t.Error("connection not closed after GOAWAY")
+	}
+}
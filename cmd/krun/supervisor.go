@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Component states.
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateBackoff  = "backoff"
+	StateFailed   = "failed"
+	StateStopped  = "stopped"
+	StateDisabled = "disabled"
+)
+
+// ErrDisabled is returned by a component that is not configured. It is not restarted.
+var ErrDisabled = errors.New("disabled")
+
+// Component is a krun subsystem - HBONE listener, H2R attachment, debug SSHD.
+type Component struct {
+	Name string
+
+	// Run starts the component and blocks until it fails or ctx is done. A nil return after ctx is
+	// done is a normal stop, ErrDisabled means the component is not configured, anything else is
+	// a failure and the component is restarted.
+	Run func(ctx context.Context) error
+
+	// Critical components stop krun if they fail more than MaxFailures times in a row.
+	Critical bool
+
+	// MaxFailures is the number of consecutive failures after which the component is not restarted.
+	// 0 means restart forever.
+	MaxFailures int
+}
+
+// ComponentStatus is the health of a component, as reported by the status endpoint.
+type ComponentStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Critical  bool      `json:"critical,omitempty"`
+	Restarts  int       `json:"restarts"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Supervisor runs the components, restarting them with backoff.
+type Supervisor struct {
+	// MinBackoff and MaxBackoff bound the restart delay. Defaults 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	m      sync.RWMutex
+	status []*ComponentStatus
+	fatal  chan error
+	wg     sync.WaitGroup
+}
+
+// NewSupervisor creates a supervisor.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		fatal:      make(chan error, 1),
+	}
+}
+
+// Go starts the component in background.
+func (s *Supervisor) Go(ctx context.Context, c *Component) {
+	st := &ComponentStatus{Name: c.Name, State: StateStarting, Critical: c.Critical, Since: time.Now()}
+	s.m.Lock()
+	s.status = append(s.status, st)
+	s.m.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx, c, st)
+	}()
+}
+
+func (s *Supervisor) run(ctx context.Context, c *Component, st *ComponentStatus) {
+	backoff := s.MinBackoff
+	for {
+		s.setState(st, StateRunning, nil)
+		start := time.Now()
+		err := runSafe(ctx, c)
+		if ctx.Err() != nil {
+			s.setState(st, StateStopped, nil)
+			return
+		}
+		if err == ErrDisabled {
+			s.setState(st, StateDisabled, nil)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("%s exited", c.Name)
+		}
+		// A component that was running for a while is healthy again.
+		if time.Since(start) > s.MaxBackoff {
+			backoff = s.MinBackoff
+			s.m.Lock()
+			st.Failures = 0
+			s.m.Unlock()
+		}
+
+		s.m.Lock()
+		st.Failures++
+		failures := st.Failures
+		s.m.Unlock()
+		supLog.Warn("Component failed", "name", c.Name, "failures", failures, "error", err)
+
+		if c.MaxFailures > 0 && failures >= c.MaxFailures {
+			s.setState(st, StateFailed, err)
+			if c.Critical {
+				select {
+				case s.fatal <- fmt.Errorf("%s failed: %v", c.Name, err):
+				default:
+				}
+			}
+			return
+		}
+
+		s.setState(st, StateBackoff, err)
+		select {
+		case <-ctx.Done():
+			s.setState(st, StateStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = backoff * 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+		s.m.Lock()
+		st.Restarts++
+		s.m.Unlock()
+	}
+}
+
+// runSafe runs the component, converting panics to errors.
+func runSafe(ctx context.Context, c *Component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.Run(ctx)
+}
+
+func (s *Supervisor) setState(st *ComponentStatus, state string, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if st.State != state {
+		st.Since = time.Now()
+	}
+	st.State = state
+	if err != nil {
+		st.LastError = err.Error()
+	}
+}
+
+// Fatal receives the failure of a critical component.
+func (s *Supervisor) Fatal() <-chan error {
+	return s.fatal
+}
+
+// Wait for all components to stop.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Status returns a snapshot of the components health.
+func (s *Supervisor) Status() []ComponentStatus {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	res := []ComponentStatus{}
+	for _, st := range s.status {
+		res = append(res, *st)
+	}
+	return res
+}
+
+// Healthy returns false if a critical component is not running.
+func (s *Supervisor) Healthy() bool {
+	for _, st := range s.Status() {
+		if st.Critical && st.State != StateRunning {
+			return false
+		}
+	}
+	return true
+}
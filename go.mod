@@ -4,7 +4,13 @@ go 1.16
 
 replace github.com/costinm/krun/pkg/urest => ./pkg/urest
 
+replace github.com/costinm/krun/third_party => ./third_party
+
 require (
 	github.com/GoogleCloudPlatform/cloud-run-mesh v0.0.0-20220128230121-cac57262761b
+	github.com/costinm/krun/third_party v0.0.0-20220127213137-ae2fe5bcc4b1
+	google.golang.org/grpc v1.41.0
 	google.golang.org/protobuf v1.27.1 // indirect
+	k8s.io/client-go v0.22.2 // indirect
+	software.sslmate.com/src/go-pkcs12 v0.0.0-20210415151418-c5206de65a78
 )
@@ -0,0 +1,151 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"google.golang.org/grpc"
+)
+
+// Signer is the common interface of the CA clients - MeshCA, CAS, Istiod, Vault.
+type Signer interface {
+	// CSRSign signs a PEM encoded CSR, returning the PEM chain with the workload cert first.
+	CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error)
+}
+
+// RootProvider is implemented by the CA clients that can return the trust anchors - CAS, Vault.
+type RootProvider interface {
+	GetRootCertBundle(ctx context.Context) ([]string, error)
+}
+
+// Options are common settings passed to the signer factories.
+type Options struct {
+	// GRPCOptions are appended to the options used to dial the CA - for example OTel interceptors.
+	GRPCOptions []grpc.DialOption
+
+	// TrustedRoots is used to verify an Istio CA. If nil, the mesh-env CitadelRoot is used.
+	TrustedRoots *x509.CertPool
+
+	// Retry policy for the gRPC calls to the CA. If nil, DefaultRetryPolicy is used.
+	Retry *RetryPolicy
+
+	// ProvCert is a directory with a provisioning cert - cert-chain.pem and key.pem. If set, the
+	// Istio CA is authenticated with mTLS using this cert, instead of STS tokens.
+	ProvCert string
+
+	// KeyProtector decrypts the provisioning cert key, if it is encrypted.
+	KeyProtector KeyProtector
+}
+
+// dialOptions returns the GRPCOptions, with the retry interceptor first.
+func (o *Options) dialOptions() []grpc.DialOption {
+	r := o.Retry
+	if r == nil {
+		r = DefaultRetryPolicy
+	}
+	return append([]grpc.DialOption{r.DialOption()}, o.GRPCOptions...)
+}
+
+// Factory creates a Signer. The target is the part of the address after the provider
+// scheme - empty if the provider defaults should be used.
+type Factory func(ctx context.Context, kr *mesh.KRun, target string, opts *Options) (Signer, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// Register a signer factory, keyed by provider name. The name is also used as URL scheme.
+func Register(name string, f Factory) {
+	mu.Lock()
+	factories[name] = f
+	mu.Unlock()
+}
+
+// Providers returns the names of the registered providers.
+func Providers() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	res := []string{}
+	for k := range factories {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// New creates a signer for the address, which can be:
+// - empty: istiod if mesh-env has the connector and root cert, meshca otherwise
+// - a provider name: "meshca", "cas", "istiod", "vault", "local"
+// - a URL with the provider as scheme: "istiod://10.1.1.1:15012", "cas://projects/P/locations/L/caPools/POOL"
+// - a host:port, for an Istio compatible CA.
+// - a comma separated list of the above, in order of preference - the next CA is used if signing fails.
+func New(ctx context.Context, kr *mesh.KRun, addr string, opts *Options) (Signer, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if strings.Contains(addr, ",") {
+		names := []string{}
+		signers := []Signer{}
+		for _, a := range strings.Split(addr, ",") {
+			a = strings.TrimSpace(a)
+			if a == "" {
+				continue
+			}
+			s, err := New(ctx, kr, a, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", a, err)
+			}
+			names = append(names, a)
+			signers = append(signers, s)
+		}
+		return NewFailover(names, signers), nil
+	}
+	name, target := ParseAddr(kr, addr)
+	mu.RLock()
+	f := factories[name]
+	mu.RUnlock()
+	if f == nil {
+		return nil, fmt.Errorf("unknown CA provider %s, known: %v", name, Providers())
+	}
+	return f(ctx, kr, target, opts)
+}
+
+// ParseAddr returns the provider name and target for a CA address.
+func ParseAddr(kr *mesh.KRun, addr string) (string, string) {
+	if addr == "" {
+		if kr.CitadelRoot != "" && kr.MeshConnectorAddr != "" {
+			return "istiod", ""
+		}
+		return "meshca", ""
+	}
+	if i := strings.Index(addr, "://"); i > 0 {
+		return addr[0:i], addr[i+3:]
+	}
+	mu.RLock()
+	_, ok := factories[addr]
+	mu.RUnlock()
+	if ok {
+		return addr, ""
+	}
+	return "istiod", addr
+}
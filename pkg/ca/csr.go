@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+// SpiffeID returns the workload identity, in the Istio format.
+func SpiffeID(kr *mesh.KRun) string {
+	return "spiffe://" + kr.TrustDomain + "/ns/" + kr.Namespace + "/sa/" + kr.KSA
+}
+
+// Key types for the workload key. ECDSA keys make the mTLS handshakes cheaper. Ed25519 is
+// not accepted by all CAs.
+const (
+	KeyRSA2048   = "rsa-2048"
+	KeyRSA4096   = "rsa-4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+)
+
+// KeyTypes are the supported key types.
+var KeyTypes = []string{KeyRSA2048, KeyRSA4096, KeyECDSAP256, KeyECDSAP384, KeyEd25519}
+
+// GenerateKey creates a private key of the given type. Default is rsa-2048.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported key type %q, expecting one of %s", keyType, strings.Join(KeyTypes, ", "))
+}
+
+// KeyType returns the key type of a public key, or an empty string if not supported.
+func KeyType(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyECDSAP256
+		case elliptic.P384():
+			return KeyECDSAP384
+		}
+	case ed25519.PublicKey:
+		return KeyEd25519
+	}
+	return ""
+}
+
+// ParsePrivateKey parses a PEM private key - PKCS8, or the PKCS1 and EC formats.
+func ParsePrivateKey(privPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privPEM)
+	if block == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+	return signer, nil
+}
+
+// CheckKey verifies that the cert was issued for the private key - a CA may ignore the
+// requested key or return a cert for another workload.
+func CheckKey(privPEM []byte, cert *x509.Certificate) error {
+	priv, err := ParsePrivateKey(privPEM)
+	if err != nil {
+		return err
+	}
+	pub, ok := priv.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return fmt.Errorf("certificate key %s doesn't match the private key %s",
+			KeyType(cert.PublicKey), KeyType(priv.Public()))
+	}
+	return nil
+}
+
+// NewCSR generates a private key of the given type and a CSR for the SPIFFE identity.
+// Returns the PEM encoded private key and CSR.
+func NewCSR(keyType, org, san string) (privPEM []byte, csrPEM []byte, err error) {
+	priv, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := url.Parse(san)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: []string{org},
+		},
+		URIs: []*url.URL{u},
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	return
+}
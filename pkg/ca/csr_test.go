@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestKeyTypes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "csr")
+	defer os.RemoveAll(dir)
+	local, err := NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	san := "spiffe://cluster.local/ns/test/sa/default"
+	other, _, _ := NewCSR(KeyECDSAP256, "cluster.local", san)
+
+	for _, kt := range KeyTypes {
+		k, err := GenerateKey(kt)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if got := KeyType(k.Public()); got != kt {
+			t.Errorf("%s: generated %s", kt, got)
+		}
+
+		priv, csrPEM, err := NewCSR(kt, "cluster.local", san)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		block, _ := pem.Decode(csrPEM)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if err = csr.CheckSignature(); err != nil {
+			t.Errorf("%s: invalid CSR signature %v", kt, err)
+		}
+		if len(csr.URIs) != 1 || csr.URIs[0].String() != san || KeyType(csr.PublicKey) != kt {
+			t.Errorf("%s: unexpected CSR %v %s", kt, csr.URIs, KeyType(csr.PublicKey))
+		}
+
+		// The key is saved as PKCS8.
+		if block, _ = pem.Decode(priv); block == nil || block.Type != "PRIVATE KEY" {
+			t.Fatalf("%s: unexpected key PEM %s", kt, priv)
+		}
+		pk, err := ParsePrivateKey(priv)
+		if err != nil || KeyType(pk.Public()) != kt {
+			t.Errorf("%s: PKCS8 round trip failed %v", kt, err)
+		}
+
+		chain, err := local.CSRSign(context.Background(), csrPEM, 3600)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		block, _ = pem.Decode([]byte(chain[0]))
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		if err = CheckKey(priv, cert); err != nil {
+			t.Errorf("%s: %v", kt, err)
+		}
+		if err = CheckKey(other, cert); err == nil {
+			t.Errorf("%s: key mismatch not detected", kt)
+		}
+	}
+
+	if _, err := GenerateKey("dsa"); err == nil {
+		t.Error("unsupported key type accepted")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Failover signs with the first CA that succeeds, in order. A CA outage falls back to the next
+// provider, and the preferred CA is used again once it recovers.
+type Failover struct {
+	Names   []string
+	Signers []Signer
+
+	m    sync.Mutex
+	last string
+}
+
+// NewFailover returns a signer for the list of CAs, in order of preference.
+func NewFailover(names []string, signers []Signer) *Failover {
+	return &Failover{Names: names, Signers: signers}
+}
+
+// CSRSign tries each CA in order, returning the first chain.
+func (f *Failover) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+	errs := []string{}
+	for i, s := range f.Signers {
+		chain, err := s.CSRSign(ctx, csrPEM, certValidTTLInSec)
+		if err == nil {
+			f.m.Lock()
+			f.last = f.Names[i]
+			f.m.Unlock()
+			return chain, nil
+		}
+		errs = append(errs, f.Names[i]+": "+err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no CA configured")
+	}
+	return nil, fmt.Errorf("all CAs failed: %s", strings.Join(errs, "; "))
+}
+
+// Last returns the name of the CA that signed the last cert.
+func (f *Failover) Last() string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.last
+}
+
+// GetRootCertBundle returns the roots of all the CAs that publish them - the workloads must trust
+// the roots of all the CAs in the list. Fails only if no CA returned the roots.
+func (f *Failover) GetRootCertBundle(ctx context.Context) ([]string, error) {
+	res := []string{}
+	errs := []string{}
+	for i, s := range f.Signers {
+		rp, ok := s.(RootProvider)
+		if !ok {
+			continue
+		}
+		roots, err := rp.GetRootCertBundle(ctx)
+		if err != nil {
+			errs = append(errs, f.Names[i]+": "+err.Error())
+			continue
+		}
+		res = append(res, roots...)
+	}
+	if len(res) == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("failed to get roots: %s", strings.Join(errs, "; "))
+	}
+	return res, nil
+}
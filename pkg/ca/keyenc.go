@@ -0,0 +1,205 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptedKeyType is the PEM block type of a private key encrypted with a KeyProtector.
+const EncryptedKeyType = "KRUN ENCRYPTED PRIVATE KEY"
+
+// KeyProtector encrypts the private keys saved on disk, using a key-encryption-key. Implemented
+// by LocalKEK, with the key in a file, and can be implemented by a KMS client.
+type KeyProtector interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// KMSFactory creates a KeyProtector for the part of the address after the scheme.
+type KMSFactory func(target string) (KeyProtector, error)
+
+var kmsFactories = map[string]KMSFactory{
+	"localkms": NewLocalKMS,
+}
+
+// RegisterKMS registers a KeyProtector factory, keyed by URL scheme.
+func RegisterKMS(scheme string, f KMSFactory) {
+	mu.Lock()
+	kmsFactories[scheme] = f
+	mu.Unlock()
+}
+
+// NewKeyProtector returns the KeyProtector for the address, which can be:
+// - empty: keys are not encrypted, returns nil
+// - a registered KMS URL, like "localkms:///path/to/dir"
+// - the path of a file with the key-encryption-key.
+func NewKeyProtector(addr string) (KeyProtector, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if i := strings.Index(addr, "://"); i > 0 {
+		mu.RLock()
+		f := kmsFactories[addr[0:i]]
+		mu.RUnlock()
+		if f == nil {
+			return nil, fmt.Errorf("unknown KMS %s", addr[0:i])
+		}
+		return f(addr[i+3:])
+	}
+	k, err := LoadKEK(addr)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LocalKEK encrypts with AES-256-GCM.
+type LocalKEK struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKEK creates a KeyProtector for a 32 byte key.
+func NewLocalKEK(key []byte) (*LocalKEK, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key-encryption-key must be 32 bytes, got %d", len(key))
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKEK{aead: aead}, nil
+}
+
+// LoadKEK loads the key-encryption-key from a file - 32 raw bytes or base64 encoded.
+func LoadKEK(file string) (*LocalKEK, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 32 {
+		data, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key-encryption-key %s: %v", file, err)
+		}
+	}
+	return NewLocalKEK(data)
+}
+
+// NewLocalKMS is a stand-in for a KMS, for development and tests: the key-encryption-key is
+// kept in dir/kek, created if missing.
+func NewLocalKMS(dir string) (KeyProtector, error) {
+	file := filepath.Join(dir, "kek")
+	k, err := LoadKEK(file)
+	if err == nil {
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalKEK(key)
+}
+
+// Encrypt returns the nonce followed by the sealed plaintext.
+func (k *LocalKEK) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens the result of Encrypt.
+func (k *LocalKEK) Decrypt(ciphertext []byte) ([]byte, error) {
+	ns := k.aead.NonceSize()
+	if len(ciphertext) < ns {
+		return nil, errors.New("encrypted key too short")
+	}
+	res, err := k.aead.Open(nil, ciphertext[:ns], ciphertext[ns:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key, wrong key-encryption-key: %v", err)
+	}
+	return res, nil
+}
+
+// EncryptKey returns the private key PEM encrypted with kp, as an EncryptedKeyType PEM block.
+// If kp is nil the key is returned unchanged.
+func EncryptKey(kp KeyProtector, privPEM []byte) ([]byte, error) {
+	if kp == nil {
+		return privPEM, nil
+	}
+	ct, err := kp.Encrypt(privPEM)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: EncryptedKeyType, Bytes: ct}), nil
+}
+
+// DecryptKey returns the plain private key PEM. Keys that are not encrypted are returned unchanged,
+// so existing files keep working after encryption is enabled.
+func DecryptKey(kp KeyProtector, data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != EncryptedKeyType {
+		return data, nil
+	}
+	if kp == nil {
+		return nil, errors.New("private key is encrypted, missing key-encryption-key")
+	}
+	return kp.Decrypt(block.Bytes)
+}
+
+// LoadX509KeyPair is tls.LoadX509KeyPair, decrypting the key if needed.
+func LoadX509KeyPair(certFile, keyFile string, kp KeyProtector) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err = DecryptKey(kp, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKEK(t *testing.T, b byte) *LocalKEK {
+	k, err := NewLocalKEK(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyEncryption(t *testing.T) {
+	kek := newTestKEK(t, 1)
+	priv, _, err := NewCSR(KeyECDSAP256, "cluster.local", "spiffe://cluster.local/ns/test/sa/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := EncryptKey(kek, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(enc, priv) || !bytes.Contains(enc, []byte(EncryptedKeyType)) {
+		t.Fatalf("key not encrypted %s", enc)
+	}
+	dec, err := DecryptKey(kek, enc)
+	if err != nil || !bytes.Equal(dec, priv) {
+		t.Errorf("round trip failed %v", err)
+	}
+
+	if _, err := DecryptKey(newTestKEK(t, 2), enc); err == nil {
+		t.Error("wrong key-encryption-key accepted")
+	}
+	if _, err := DecryptKey(nil, enc); err == nil {
+		t.Error("encrypted key returned without key-encryption-key")
+	}
+
+	ct, _ := kek.Encrypt(priv)
+	for _, n := range []int{0, 5, len(ct) - 1} {
+		if _, err := kek.Decrypt(ct[:n]); err == nil {
+			t.Errorf("truncated ciphertext %d accepted", n)
+		}
+	}
+
+	// Plain keys saved before encryption was enabled are returned as is.
+	for _, kp := range []KeyProtector{nil, kek} {
+		dec, err = DecryptKey(kp, priv)
+		if err != nil || !bytes.Equal(dec, priv) {
+			t.Errorf("plain key changed %v", err)
+		}
+	}
+	if _, err := NewLocalKEK([]byte("short")); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+func TestLoadKEK(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kek")
+	defer os.RemoveAll(dir)
+	key := bytes.Repeat([]byte{3}, 32)
+	want, _ := newTestKEK(t, 3).Encrypt([]byte("test"))
+
+	for name, data := range map[string][]byte{
+		"raw":    key,
+		"base64": []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+	} {
+		file := filepath.Join(dir, name)
+		ioutil.WriteFile(file, data, 0600)
+		kp, err := NewKeyProtector(file)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if res, err := kp.Decrypt(want); err != nil || string(res) != "test" {
+			t.Errorf("%s: loaded a different key %v", name, err)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "invalid"), []byte("not a key"), 0600)
+	if _, err := LoadKEK(filepath.Join(dir, "invalid")); err == nil {
+		t.Error("invalid key accepted")
+	}
+}
+
+func TestLocalKMS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "localkms")
+	defer os.RemoveAll(dir)
+	kmsDir := filepath.Join(dir, "kms")
+
+	kp, err := NewKeyProtector("localkms://" + kmsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(kmsDir, "kek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("kek mode %v", fi.Mode())
+	}
+
+	// The same key is loaded on restart.
+	ct, _ := kp.Encrypt([]byte("test"))
+	kp2, err := NewLocalKMS(kmsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := kp2.Decrypt(ct); err != nil || string(res) != "test" {
+		t.Errorf("kek not reloaded %v", err)
+	}
+
+	if _, err := NewKeyProtector("otherkms://x"); err == nil {
+		t.Error("unknown KMS accepted")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	Register("local", NewLocal)
+}
+
+// LocalCA is a self-signed CA with the root key on disk, for development and tests without
+// GCP or Istiod. The certs use the same SPIFFE identity format as the mesh CAs.
+type LocalCA struct {
+	// TrustDomain of the issued certs.
+	TrustDomain string
+
+	// Identity is the SPIFFE ID of the certs issued by this instance - like MeshCA, the identity
+	// is not taken from the CSR. If empty, the CSR URI is used if it is in the trust domain.
+	Identity string
+
+	key     crypto.Signer
+	root    *x509.Certificate
+	rootPEM string
+}
+
+// NewLocal creates a local CA for the workload identity. Target is the directory of the root key,
+// default is krun/ca in the user config dir.
+func NewLocal(ctx context.Context, kr *mesh.KRun, target string, opts *Options) (Signer, error) {
+	if target == "" {
+		d, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		target = filepath.Join(d, "krun", "ca")
+	}
+	td := kr.TrustDomain
+	if td == "" {
+		td = "cluster.local"
+	}
+	c, err := NewLocalCA(target, td)
+	if err != nil {
+		return nil, err
+	}
+	if kr.Namespace != "" && kr.KSA != "" {
+		c.Identity = "spiffe://" + td + "/ns/" + kr.Namespace + "/sa/" + kr.KSA
+	}
+	return c, nil
+}
+
+// NewLocalCA loads the root key and cert from dir - root-key.pem and root-cert.pem - creating them if missing.
+func NewLocalCA(dir, trustDomain string) (*LocalCA, error) {
+	c := &LocalCA{TrustDomain: trustDomain}
+	keyFile := filepath.Join(dir, "root-key.pem")
+	certFile := filepath.Join(dir, "root-cert.pem")
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return c, c.create(dir, keyFile, certFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.key, err = ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid root cert %s", certFile)
+	}
+	c.root, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	c.rootPEM = string(certPEM)
+	return c, nil
+}
+
+// create generates a new root, valid for 10 years.
+func (c *LocalCA) create(dir, keyFile, certFile string) error {
+	key, err := GenerateKey(KeyECDSAP256)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randSerial(),
+		Subject:               pkix.Name{Organization: []string{c.TrustDomain}, CommonName: "krun local root"},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	c.root, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	c.key = key
+	c.rootPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, []byte(c.rootPEM), 0644)
+}
+
+// CSRSign issues a workload cert for the CSR key. The chain includes the root.
+func (c *LocalCA) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, errors.New("invalid PEM CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	id := c.Identity
+	if id == "" {
+		if len(csr.URIs) != 1 || csr.URIs[0].Scheme != "spiffe" || csr.URIs[0].Host != c.TrustDomain {
+			return nil, fmt.Errorf("CSR must have one SPIFFE URI in trust domain %s", c.TrustDomain)
+		}
+		id = csr.URIs[0].String()
+	}
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(certValidTTLInSec) * time.Second
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(c.root.NotAfter) {
+		notAfter = c.root.NotAfter
+	}
+	usage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randSerial(),
+		Subject:      pkix.Name{Organization: []string{c.TrustDomain}},
+		URIs:         []*url.URL{u},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     usage,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.root, csr.PublicKey, c.key)
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), c.rootPEM}, nil
+}
+
+// GetRootCertBundle returns the local root.
+func (c *LocalCA) GetRootCertBundle(ctx context.Context) ([]string, error) {
+	return []string{c.rootPEM}, nil
+}
+
+func randSerial() *big.Int {
+	s, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return s
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLocalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, _ := c.GetRootCertBundle(context.Background())
+	pool := x509.NewCertPool()
+	if len(roots) != 1 || !pool.AppendCertsFromPEM([]byte(roots[0])) {
+		t.Fatalf("invalid roots %v", roots)
+	}
+
+	// A second instance using the same dir loads the root.
+	c2, err := NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c2.root.Equal(c.root) {
+		t.Error("root not reloaded from dir")
+	}
+
+	ctx := context.Background()
+	id := "spiffe://cluster.local/ns/test/sa/default"
+	for _, kt := range []string{KeyECDSAP256, KeyRSA2048, KeyEd25519} {
+		priv, csr, err := NewCSR(kt, "cluster.local", id)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		chain, err := c2.CSRSign(ctx, csr, 3600)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		if len(chain) != 2 || chain[1] != roots[0] {
+			t.Fatalf("%s: expecting leaf and root, got %d certs", kt, len(chain))
+		}
+		if _, err := tls.X509KeyPair([]byte(chain[0]), priv); err != nil {
+			t.Errorf("%s: cert doesn't match the key: %v", kt, err)
+		}
+
+		block, _ := pem.Decode([]byte(chain[0]))
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(kt, err)
+		}
+		for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+			if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+				t.Errorf("%s: verify %v: %v", kt, usage, err)
+			}
+		}
+		if len(leaf.URIs) != 1 || leaf.URIs[0].String() != id {
+			t.Errorf("%s: unexpected URIs %v", kt, leaf.URIs)
+		}
+		if ttl := time.Until(leaf.NotAfter); ttl > time.Hour || ttl < 55*time.Minute {
+			t.Errorf("%s: unexpected TTL %v", kt, ttl)
+		}
+	}
+
+	// Without an Identity, only SPIFFE IDs in the trust domain are signed.
+	_, csr, _ := NewCSR(KeyECDSAP256, "other", "spiffe://other/ns/test/sa/default")
+	if _, err := c.CSRSign(ctx, csr, 3600); err == nil {
+		t.Error("signed CSR for another trust domain")
+	}
+	if _, err := c.CSRSign(ctx, []byte("invalid"), 3600); err == nil {
+		t.Error("signed invalid CSR")
+	}
+
+	// With an Identity, the CSR SAN is ignored.
+	c.Identity = id
+	chain, err := c.CSRSign(ctx, csr, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(chain[0]))
+	leaf, _ := x509.ParseCertificate(block.Bytes)
+	if len(leaf.URIs) != 1 || leaf.URIs[0].String() != id {
+		t.Errorf("identity not used, got %v", leaf.URIs)
+	}
+}
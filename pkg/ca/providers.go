@@ -0,0 +1,156 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/sts"
+	"github.com/costinm/krun/third_party/istio/cas"
+	"github.com/costinm/krun/third_party/istio/istioca"
+	"github.com/costinm/krun/third_party/istio/meshca"
+	"google.golang.org/grpc"
+)
+
+func init() {
+	Register("meshca", NewMeshCA)
+	Register("cas", NewCAS)
+	Register("istiod", NewIstiod)
+}
+
+// NewMeshCA creates a MeshCA client, authenticated with the federated ID token.
+// Target defaults to meshca.googleapis.com:443.
+func NewMeshCA(ctx context.Context, kr *mesh.KRun, target string, opts *Options) (Signer, error) {
+	tokenProvider, err := newSTS(kr)
+	if err != nil {
+		return nil, err
+	}
+	tokenProvider.UseAccessToken = false // even if audience is provided.
+
+	var ol []grpc.DialOption
+	ol = append(ol, grpc.WithPerRPCCredentials(tokenProvider))
+	ol = append(ol, opts.dialOptions()...)
+
+	c, err := meshca.NewGoogleCAClient(target, ol)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCAS creates a CAS client, authenticated with the federated access token.
+//
+// Target is the CA pool, defaults to projects/PROJECT_ID/locations/REGION/caPools/istio, with optional
+// query parameters:
+// - template=NAME - certificate template, a name in the pool location or the full resource name
+// - mode=reflected - use REFLECTED_SPIFFE instead of setting the workload SPIFFE ID as URI SAN
+func NewCAS(ctx context.Context, kr *mesh.KRun, target string, opts *Options) (Signer, error) {
+	tokenProvider, err := newSTS(kr)
+	if err != nil {
+		return nil, err
+	}
+	// REFLECTED_SPIFFE requires the caller to have a SPIFFE identity - the federated token of the KSA.
+	// The default explicit mode sets the SPIFFE ID in the request, and requires privateca.certificates.create.
+	// The token MUST be the federated access token
+	tokenProvider.UseAccessToken = true // even if audience is provided.
+
+	var ol []grpc.DialOption
+	ol = append(ol, grpc.WithPerRPCCredentials(tokenProvider))
+	ol = append(ol, opts.dialOptions()...)
+
+	casOpts := &cas.Options{}
+	if kr.Namespace != "" && kr.KSA != "" {
+		casOpts.SpiffeID = SpiffeID(kr)
+	}
+	if i := strings.Index(target, "?"); i >= 0 {
+		q, err := url.ParseQuery(target[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		target = target[:i]
+		casOpts.ReflectedSpiffe = q.Get("mode") == "reflected"
+		casOpts.Template = q.Get("template")
+	}
+	if target == "" {
+		target = "projects/" + kr.ProjectId + "/locations/" + kr.Region() + "/caPools/istio"
+	}
+	if casOpts.Template != "" && !strings.Contains(casOpts.Template, "/") {
+		// Templates are in the same location as the pool.
+		parts := strings.Split(target, "/")
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("invalid CA pool %s", target)
+		}
+		casOpts.Template = strings.Join(parts[0:4], "/") + "/certificateTemplates/" + casOpts.Template
+	}
+	c, err := cas.NewGoogleCASClient(target, casOpts, ol)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewIstiod creates a client for Istiod or another Istio compatible CA.
+// Target defaults to the mesh connector address, port 15012.
+func NewIstiod(ctx context.Context, kr *mesh.KRun, target string, opts *Options) (Signer, error) {
+	if target == "" {
+		if kr.MeshConnectorAddr == "" {
+			return nil, errors.New("missing mesh connector address, 'hgate' service not found in mesh env")
+		}
+		target = kr.MeshConnectorAddr + ":15012"
+	}
+	roots := opts.TrustedRoots
+	if roots == nil && kr.CitadelRoot != "" {
+		roots = x509.NewCertPool()
+		roots.AppendCertsFromPEM([]byte(kr.CitadelRoot))
+	}
+
+	io := &istioca.Options{
+		CAEndpoint:    target,
+		TrustedRoots:  roots,
+		CAEndpointSAN: "istiod.istio-system.svc",
+		GRPCOptions:   opts.dialOptions(),
+		ProvCert:      opts.ProvCert,
+	}
+	if opts.KeyProtector != nil {
+		io.LoadProvCert = func(dir string) (tls.Certificate, error) {
+			return LoadX509KeyPair(filepath.Join(dir, "cert-chain.pem"), filepath.Join(dir, "key.pem"), opts.KeyProtector)
+		}
+	}
+	if opts.ProvCert == "" {
+		tokenProvider, err := newSTS(kr)
+		if err != nil {
+			return nil, err
+		}
+		// Audience: "istio-ca"
+		io.TokenProvider = tokenProvider
+	}
+	c, err := istioca.NewCitadelClient(io)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newSTS(kr *mesh.KRun) (*sts.STS, error) {
+	return sts.NewSTS(kr)
+}
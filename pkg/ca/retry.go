@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy is applied to the calls to the CA - replacing the Istio CARetryInterceptor for the gRPC CAs.
+type RetryPolicy struct {
+	// Timeout for each attempt. Default 10s.
+	Timeout time.Duration
+
+	// MaxAttempts, including the first call. Default 5.
+	MaxAttempts int
+
+	// MinBackoff and MaxBackoff bound the delay between attempts. Defaults 200ms and 5s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Codes that are retried. Default Unavailable, DeadlineExceeded, ResourceExhausted and Aborted.
+	Codes []codes.Code
+}
+
+// DefaultRetryPolicy is used if the options don't have a policy.
+var DefaultRetryPolicy = &RetryPolicy{}
+
+var defaultRetryCodes = []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted}
+
+// DialOption returns the option adding the retry interceptor.
+func (p *RetryPolicy) DialOption() grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(p.UnaryInterceptor())
+}
+
+// UnaryInterceptor retries the calls failing with a retryable code, with a deadline for each attempt.
+func (p *RetryPolicy) UnaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return p.do(ctx, p.retryable, func(ctx context.Context) error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	}
+}
+
+// do calls f until it succeeds or fails with an error that is not retryable, with a deadline for
+// each attempt. Also used by the CAs that don't use gRPC, with their own classification of the errors.
+func (p *RetryPolicy) do(ctx context.Context, retryable func(error) bool, f func(ctx context.Context) error) error {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := p.MinBackoff
+	if backoff == 0 {
+		backoff = 200 * time.Millisecond
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = p.invoke(ctx, f)
+		if err == nil || !retryable(err) || ctx.Err() != nil || i == attempts-1 {
+			return err
+		}
+		// +/- 20% jitter
+		d := backoff + time.Duration(rand.Int63n(int64(backoff)/5*2+1)) - backoff/5
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		backoff = backoff * 2
+		if max := p.maxBackoff(); backoff > max {
+			backoff = max
+		}
+	}
+	return err
+}
+
+func (p *RetryPolicy) invoke(ctx context.Context, f func(ctx context.Context) error) error {
+	ctx, cf := context.WithTimeout(ctx, p.timeout())
+	defer cf()
+	return f(ctx)
+}
+
+func (p *RetryPolicy) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
+
+func (p *RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff == 0 {
+		return 5 * time.Second
+	}
+	return p.MaxBackoff
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	rc := p.Codes
+	if len(rc) == 0 {
+		rc = defaultRetryCodes
+	}
+	c := status.Code(err)
+	for _, r := range rc {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
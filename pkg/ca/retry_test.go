@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryInterceptor(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, MinBackoff: 100 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+	intercept := p.UnaryInterceptor()
+
+	for _, tc := range []struct {
+		code  codes.Code
+		calls int
+	}{
+		{codes.Unavailable, 3},
+		{codes.PermissionDenied, 1},
+		{codes.OK, 1},
+	} {
+		calls := 0
+		invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			calls++
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("attempt without deadline")
+			}
+			return status.Error(tc.code, "test")
+		}
+		start := time.Now()
+		err := intercept(context.Background(), "/test", nil, nil, nil, invoker)
+		if status.Code(err) != tc.code {
+			t.Errorf("%v: got %v", tc.code, err)
+		}
+		if calls != tc.calls {
+			t.Errorf("%v: got %d calls, want %d", tc.code, calls, tc.calls)
+		}
+		// 2 backoffs of 100ms +/- 20% between the 3 attempts, none after the last.
+		if d := time.Since(start); d > time.Duration(tc.calls-1)*120*time.Millisecond+50*time.Millisecond {
+			t.Errorf("%v: took %v, sleeping after the last attempt", tc.code, d)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/krun/third_party/istio/vault"
+)
+
+func init() {
+	Register("vault", NewVault)
+}
+
+// NewVault creates a Vault PKI client, for clusters outside GCP.
+//
+// Target is [http://|https://]HOST:PORT/MOUNT/ROLE, for example vault.example.com:8200/pki/workload.
+// If empty, VAULT_ADDR is used with the "pki" mount and the VAULT_PKI_ROLE role, default "workload".
+// https is used if the scheme is missing - http is intended for a local stand-in.
+//
+// VAULT_TOKEN is used if set, otherwise the client logs in with a K8S token with the "vault" audience,
+// using the VAULT_AUTH_PATH auth method (default auth/kubernetes) and VAULT_AUTH_ROLE (default the KSA).
+// VAULT_CACERT is the file with the roots to verify the server, default the system roots.
+func NewVault(ctx context.Context, kr *mesh.KRun, target string, opts *Options) (Signer, error) {
+	vo := &vault.Options{
+		Token:    os.Getenv("VAULT_TOKEN"),
+		AuthPath: os.Getenv("VAULT_AUTH_PATH"),
+		AuthRole: os.Getenv("VAULT_AUTH_ROLE"),
+	}
+	if target == "" {
+		role := os.Getenv("VAULT_PKI_ROLE")
+		if role == "" {
+			role = "workload"
+		}
+		target = os.Getenv("VAULT_ADDR") + "/pki/" + role
+	}
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "https://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if u.Host == "" || i <= 0 {
+		return nil, fmt.Errorf("invalid Vault address %s, expecting HOST:PORT/MOUNT/ROLE", target)
+	}
+	vo.Addr = u.Scheme + "://" + u.Host
+	vo.Mount, vo.Role = path[0:i], path[i+1:]
+
+	if vo.Token == "" {
+		if vo.AuthRole == "" {
+			vo.AuthRole = kr.KSA
+		}
+		vo.JWTSource = func(ctx context.Context) (string, error) {
+			return kr.GetToken(ctx, "vault")
+		}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if f := os.Getenv("VAULT_CACERT"); f != "" {
+		roots, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(roots) {
+			return nil, fmt.Errorf("invalid VAULT_CACERT %s", f)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	r := opts.Retry
+	if r == nil {
+		r = DefaultRetryPolicy
+	}
+	vo.HTTPClient = &http.Client{Transport: tr}
+	vo.Timeout = r.timeout()
+
+	c, err := vault.NewClient(vo)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultSigner{c: c, retry: r}, nil
+}
+
+// vaultSigner applies the retry policy to the Vault calls.
+type vaultSigner struct {
+	c     *vault.Client
+	retry *RetryPolicy
+}
+
+func (v *vaultSigner) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) (chain []string, err error) {
+	err = v.retry.do(ctx, vaultRetryable, func(ctx context.Context) error {
+		chain, err = v.c.CSRSign(ctx, csrPEM, certValidTTLInSec)
+		return err
+	})
+	return chain, err
+}
+
+func (v *vaultSigner) GetRootCertBundle(ctx context.Context) (roots []string, err error) {
+	err = v.retry.do(ctx, vaultRetryable, func(ctx context.Context) error {
+		roots, err = v.c.GetRootCertBundle(ctx)
+		return err
+	})
+	return roots, err
+}
+
+// vaultRetryable returns true for the 5xx and 429 responses, and for the network errors and timeouts.
+// Vault returns 503 while sealed or in standby.
+func vaultRetryable(err error) bool {
+	var he *vault.HTTPError
+	if errors.As(err, &he) {
+		return he.StatusCode >= 500 || he.StatusCode == http.StatusTooManyRequests
+	}
+	var ue *url.Error
+	return errors.As(err, &ue) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func TestVaultRetry(t *testing.T) {
+	var calls, failures int32
+	status := int32(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			w.Write([]byte(`{"errors":["test"]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"certificate":"LEAF","issuing_ca":"ROOT"}}`))
+	}))
+	defer srv.Close()
+	os.Setenv("VAULT_TOKEN", "s.tok")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	s, err := NewVault(context.Background(), mesh.New(), srv.URL+"/pki/workload",
+		&Options{Retry: &RetryPolicy{MaxAttempts: 3, MinBackoff: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		status, failures, calls int32
+		ok                      bool
+	}{
+		{http.StatusServiceUnavailable, 2, 3, true},
+		{http.StatusTooManyRequests, 3, 3, false},
+		{http.StatusForbidden, 1, 1, false},
+	} {
+		atomic.StoreInt32(&status, tc.status)
+		atomic.StoreInt32(&failures, tc.failures)
+		atomic.StoreInt32(&calls, 0)
+		_, err := s.CSRSign(context.Background(), []byte("CSR"), 0)
+		if (err == nil) != tc.ok || atomic.LoadInt32(&calls) != tc.calls {
+			t.Errorf("%d: got %v after %d calls", tc.status, err, atomic.LoadInt32(&calls))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TrustBundle merges the roots from multiple CAs, keeping track of the sources of each root.
+//
+// During a root rotation or a migration between CAs the workloads must trust all the roots.
+type TrustBundle struct {
+	m     sync.RWMutex
+	roots []*bundleRoot
+}
+
+type bundleRoot struct {
+	cert    *x509.Certificate
+	sources []string
+}
+
+// RootInfo is the provenance of a root, saved in trust-bundle.json.
+type RootInfo struct {
+	Subject  string    `json:"subject"`
+	SHA256   string    `json:"sha256"`
+	NotAfter time.Time `json:"notAfter"`
+	Sources  []string  `json:"sources"`
+}
+
+// Add the PEM certificates found in pems, recording source as provenance. Duplicates are merged.
+func (b *TrustBundle) Add(source string, pems string) error {
+	certs, err := ParseCerts(pems)
+	if err != nil {
+		return err
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, c := range certs {
+		b.add(source, c)
+	}
+	return nil
+}
+
+func (b *TrustBundle) add(source string, c *x509.Certificate) {
+	for _, r := range b.roots {
+		if r.cert.Equal(c) {
+			for _, s := range r.sources {
+				if s == source {
+					return
+				}
+			}
+			r.sources = append(r.sources, source)
+			return
+		}
+	}
+	b.roots = append(b.roots, &bundleRoot{cert: c, sources: []string{source}})
+}
+
+// Len returns the number of distinct roots.
+func (b *TrustBundle) Len() int {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return len(b.roots)
+}
+
+// PEM returns the merged roots.
+func (b *TrustBundle) PEM() string {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	res := []string{}
+	for _, r := range b.roots {
+		res = append(res, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.cert.Raw})))
+	}
+	return JoinPEM(res)
+}
+
+// Pool returns the roots as a cert pool.
+func (b *TrustBundle) Pool() *x509.CertPool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	p := x509.NewCertPool()
+	for _, r := range b.roots {
+		p.AddCert(r.cert)
+	}
+	return p
+}
+
+// Roots returns the provenance of each root.
+func (b *TrustBundle) Roots() []RootInfo {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	res := []RootInfo{}
+	for _, r := range b.roots {
+		sum := sha256.Sum256(r.cert.Raw)
+		res = append(res, RootInfo{
+			Subject:  r.cert.Subject.String(),
+			SHA256:   hex.EncodeToString(sum[:]),
+			NotAfter: r.cert.NotAfter,
+			Sources:  append([]string{}, r.sources...),
+		})
+	}
+	return res
+}
+
+// Save writes the merged roots to trust-bundle.pem and the provenance to trust-bundle.json.
+func (b *TrustBundle) Save(dir string) error {
+	err := WriteFile(filepath.Join(dir, "trust-bundle.pem"), []byte(b.PEM()), 0644)
+	if err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(b.Roots(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(filepath.Join(dir, "trust-bundle.json"), js, 0644)
+}
+
+// IsSelfSigned returns true if the PEM is a single certificate signed with its own key - a root.
+func IsSelfSigned(pemCert string) bool {
+	cl, err := ParseCerts(pemCert)
+	if err != nil || len(cl) != 1 {
+		return false
+	}
+	c := cl[0]
+	return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil
+}
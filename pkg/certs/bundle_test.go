@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a CA cert signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, k
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &k.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := x509.ParseCertificate(der)
+	return c, k, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestIsSelfSigned(t *testing.T) {
+	root, rootKey, rootPEM := newTestCert(t, "root", nil, nil)
+	_, _, intPEM := newTestCert(t, "intermediate", root, rootKey)
+	// Same subject as the root, different key - the signature doesn't verify.
+	_, _, fakePEM := newTestCert(t, "root", root, rootKey)
+
+	if !IsSelfSigned(rootPEM) {
+		t.Error("root not detected")
+	}
+	for name, p := range map[string]string{
+		"intermediate": intPEM,
+		"same subject": fakePEM,
+		"chain":        intPEM + rootPEM,
+		"invalid":      "x",
+	} {
+		if IsSelfSigned(p) {
+			t.Errorf("%s accepted as root", name)
+		}
+	}
+}
+
+func TestTrustBundle(t *testing.T) {
+	root1, _, root1PEM := newTestCert(t, "root1", nil, nil)
+	root2, root2Key, root2PEM := newTestCert(t, "root2", nil, nil)
+	leaf, _, _ := newTestCert(t, "leaf", root2, root2Key)
+
+	b := &TrustBundle{}
+	if err := b.Add("meshca", root1PEM); err != nil {
+		t.Fatal(err)
+	}
+	// Rotation: the new CA publishes both roots, and the same root is added again.
+	if err := b.Add("cas", root2PEM+root1PEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("cas", root2PEM); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 2 {
+		t.Fatalf("expecting 2 roots, got %d", b.Len())
+	}
+
+	roots := b.Roots()
+	if roots[0].Subject != root1.Subject.String() || !reflect.DeepEqual(roots[0].Sources, []string{"meshca", "cas"}) {
+		t.Errorf("unexpected provenance %v", roots[0])
+	}
+	if roots[1].Subject != root2.Subject.String() || !reflect.DeepEqual(roots[1].Sources, []string{"cas"}) {
+		t.Errorf("unexpected provenance %v", roots[1])
+	}
+
+	merged, err := ParseCerts(b.PEM())
+	if err != nil || len(merged) != 2 || !merged[0].Equal(root1) || !merged[1].Equal(root2) {
+		t.Errorf("unexpected merged PEM %v %d", err, len(merged))
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: b.Pool()}); err != nil {
+		t.Error(err)
+	}
+
+	bad := "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"
+	if err := b.Add("bad", bad); err == nil || b.Len() != 2 {
+		t.Errorf("invalid root accepted %v", err)
+	}
+
+	dir, _ := ioutil.TempDir("", "bundle")
+	defer os.RemoveAll(dir)
+	if err := b.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	js, _ := ioutil.ReadFile(filepath.Join(dir, "trust-bundle.json"))
+	saved := []RootInfo{}
+	if err := json.Unmarshal(js, &saved); err != nil || len(saved) != 2 || saved[0].SHA256 != roots[0].SHA256 {
+		t.Errorf("unexpected trust-bundle.json %v %s", err, js)
+	}
+	if p, _ := ioutil.ReadFile(filepath.Join(dir, "trust-bundle.pem")); string(p) != b.PEM() {
+		t.Errorf("unexpected trust-bundle.pem %s", p)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+// WorkloadCertDir is the default location of the workload certificates.
+const WorkloadCertDir = "/var/run/secrets/workload-spiffe-credentials"
+
+// WriteFile replaces the file atomically - the content is written to a temp
+// file in the same directory, which is then renamed.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// SaveWorkloadCerts writes the key, chain and roots using the workload cert file names.
+func SaveWorkloadCerts(dir string, priv []byte, chain []string, roots string) error {
+	if dir == "" {
+		dir = WorkloadCertDir
+	}
+	// Roots first - the cert is used as a signal that files are ready.
+	if roots != "" {
+		err := WriteFile(filepath.Join(dir, "ca_certificates.pem"), []byte(roots), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	err := WriteFile(filepath.Join(dir, "private_key.pem"), priv, 0600)
+	if err != nil {
+		return err
+	}
+	return WriteFile(filepath.Join(dir, "certificates.pem"), []byte(JoinPEM(chain)), 0644)
+}
+
+// LoadCerts reads the key, chain and roots from dir, in the workload or Istio layout. The key is
+// decrypted with kp if it is encrypted.
+func LoadCerts(dir string, kp ca.KeyProtector) (priv []byte, chain []string, roots string, err error) {
+	keyFile, chainFile, rootsFile := "private_key.pem", "certificates.pem", "ca_certificates.pem"
+	if _, err := os.Stat(filepath.Join(dir, keyFile)); os.IsNotExist(err) {
+		keyFile, chainFile, rootsFile = "key.pem", "cert-chain.pem", "root-cert.pem"
+	}
+	priv, err = ioutil.ReadFile(filepath.Join(dir, keyFile))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	priv, err = ca.DecryptKey(kp, priv)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	chainPEM, err := ioutil.ReadFile(filepath.Join(dir, chainFile))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	certs, err := ParseCerts(string(chainPEM))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(certs) == 0 {
+		return nil, nil, "", fmt.Errorf("no certificates in %s", filepath.Join(dir, chainFile))
+	}
+	for _, c := range certs {
+		chain = append(chain, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})))
+	}
+	rootsPEM, err := ioutil.ReadFile(filepath.Join(dir, rootsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, "", err
+	}
+	return priv, chain, string(rootsPEM), nil
+}
+
+// JoinPEM concatenates PEM blocks, making sure each ends with a new line.
+func JoinPEM(pems []string) string {
+	var sb strings.Builder
+	for _, p := range pems {
+		sb.WriteString(p)
+		if !strings.HasSuffix(p, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+// CertInfo describes a certificate in the chain.
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	URIs      []string  `json:"uris,omitempty"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	IsCA      bool      `json:"isCA"`
+	KeyType   string    `json:"keyType"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+
+	// Identity parsed from the SPIFFE URI, for the workload cert.
+	TrustDomain    string `json:"trustDomain,omitempty"`
+	Namespace      string `json:"namespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+// Report is the result of inspecting a chain.
+type Report struct {
+	Chain []CertInfo `json:"chain"`
+
+	// Verified is true if the chain is valid for the roots.
+	Verified bool `json:"verified"`
+
+	// Problems found - each is a reason for mTLS to fail, or fail soon.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// InspectOptions are the checks to apply.
+type InspectOptions struct {
+	// Roots to verify the chain. If nil, the chain is not verified.
+	Roots *x509.CertPool
+
+	// TrustDomain expected in the SPIFFE ID. Not checked if empty.
+	TrustDomain string
+
+	// ExpiryThreshold - certs expiring sooner are reported.
+	ExpiryThreshold time.Duration
+
+	// Now is the time used for the checks, default the current time.
+	Now time.Time
+}
+
+// ParseSpiffeID parses an Istio SPIFFE ID - spiffe://TRUST_DOMAIN/ns/NAMESPACE/sa/KSA.
+func ParseSpiffeID(id string) (td, ns, sa string, err error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != "spiffe" {
+		return "", "", "", fmt.Errorf("not a SPIFFE ID %q", id)
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "ns" || parts[2] != "sa" {
+		return u.Host, "", "", fmt.Errorf("not an Istio SPIFFE ID %q", id)
+	}
+	return u.Host, parts[1], parts[3], nil
+}
+
+// Inspect describes the chain - workload cert first - and checks the order, validity, identity and
+// verifies it against the roots.
+func Inspect(chain []*x509.Certificate, opts *InspectOptions) *Report {
+	if opts == nil {
+		opts = &InspectOptions{}
+	}
+	r := &Report{Chain: []CertInfo{}}
+	if len(chain) == 0 {
+		r.Problems = append(r.Problems, "empty certificate chain")
+		return r
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	for i, c := range chain {
+		ci := CertInfo{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			DNSNames:  c.DNSNames,
+			IsCA:      c.IsCA,
+			KeyType:   ca.KeyType(c.PublicKey),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+		}
+		for _, u := range c.URIs {
+			ci.URIs = append(ci.URIs, u.String())
+		}
+		if i == 0 {
+			r.checkIdentity(&ci, opts.TrustDomain)
+		}
+		r.Chain = append(r.Chain, ci)
+
+		switch {
+		case now.Before(c.NotBefore):
+			r.problem("cert %d (%s) not valid until %v", i, ci.Subject, c.NotBefore)
+		case now.After(c.NotAfter):
+			r.problem("cert %d (%s) expired at %v", i, ci.Subject, c.NotAfter)
+		case opts.ExpiryThreshold > 0 && c.NotAfter.Sub(now) < opts.ExpiryThreshold:
+			r.problem("cert %d (%s) expires in %v", i, ci.Subject, c.NotAfter.Sub(now).Round(time.Second))
+		}
+
+		// Each cert must be signed by the next one.
+		if i+1 < len(chain) {
+			if err := c.CheckSignatureFrom(chain[i+1]); err != nil {
+				r.problem("cert %d (%s) is not signed by cert %d (%s): %v", i, ci.Subject, i+1,
+					chain[i+1].Subject.String(), err)
+			}
+		}
+	}
+	if chain[0].IsCA {
+		r.problem("first cert in the chain is a CA, expecting the workload cert")
+	}
+
+	if opts.Roots != nil {
+		err := verifyChain(chain, opts.Roots, now)
+		if err != nil {
+			r.problem("chain verification failed: %v", err)
+		} else {
+			r.Verified = true
+		}
+	}
+	return r
+}
+
+func (r *Report) checkIdentity(ci *CertInfo, trustDomain string) {
+	if len(ci.URIs) == 0 {
+		r.problem("workload cert has no SPIFFE URI")
+		return
+	}
+	td, ns, sa, err := ParseSpiffeID(ci.URIs[0])
+	ci.TrustDomain, ci.Namespace, ci.ServiceAccount = td, ns, sa
+	if err != nil {
+		r.problem("%v", err)
+	}
+	if trustDomain != "" && td != "" && td != trustDomain {
+		r.problem("trust domain mismatch: cert has %q, mesh uses %q", td, trustDomain)
+	}
+}
+
+func (r *Report) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// verifyChain verifies the workload cert using the rest of the chain as intermediates.
+func verifyChain(chain []*x509.Certificate, roots *x509.CertPool, now time.Time) error {
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	chains, err := chain[0].Verify(opts)
+	if err != nil {
+		return err
+	}
+	if len(chains) == 0 {
+		return errors.New("no valid chain")
+	}
+	return nil
+}
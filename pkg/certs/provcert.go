@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"github.com/costinm/krun/pkg/ca"
+)
+
+// ProvCert is a long-lived provisioning certificate, exchanged with Istiod for the workload
+// certificate over mTLS. Used when no K8S or GCP token source exists - for example VMs
+// onboarded once with a bootstrap cert.
+//
+// The directory uses the Istio layout: cert-chain.pem, key.pem and optional root-cert.pem.
+type ProvCert struct {
+	Dir string
+
+	// SpiffeID of the provisioning cert - the workload identity.
+	SpiffeID string
+
+	// Roots from root-cert.pem, nil if missing.
+	Roots *x509.CertPool
+
+	// RootsPEM is the content of root-cert.pem.
+	RootsPEM string
+
+	NotAfter time.Time
+}
+
+// LoadProvCert loads and checks the provisioning cert in dir. The key is decrypted with kp, if
+// it is encrypted.
+func LoadProvCert(dir string, kp ca.KeyProtector) (*ProvCert, error) {
+	pair, err := ca.LoadX509KeyPair(filepath.Join(dir, "cert-chain.pem"), filepath.Join(dir, "key.pem"), kp)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("provisioning cert in %s expired at %v", dir, leaf.NotAfter)
+	}
+	if len(leaf.URIs) == 0 {
+		return nil, errors.New("provisioning cert has no SPIFFE URI")
+	}
+	p := &ProvCert{Dir: dir, SpiffeID: leaf.URIs[0].String(), NotAfter: leaf.NotAfter}
+
+	rootPEM, err := ioutil.ReadFile(filepath.Join(dir, "root-cert.pem"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(rootPEM) > 0 {
+		p.Roots = x509.NewCertPool()
+		if !p.Roots.AppendCertsFromPEM(rootPEM) {
+			return nil, fmt.Errorf("invalid root-cert.pem in %s", dir)
+		}
+		p.RootsPEM = string(rootPEM)
+	}
+	return p, nil
+}
+
+// SetIdentity sets the trust domain, namespace and KSA from the provisioning cert - there is
+// no K8S or mesh-env to provide them, and Istiod signs only for the identity of the cert.
+func (p *ProvCert) SetIdentity(kr *mesh.KRun) error {
+	td, ns, sa, err := ParseSpiffeID(p.SpiffeID)
+	if err != nil {
+		return err
+	}
+	kr.TrustDomain, kr.Namespace, kr.KSA = td, ns, sa
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/costinm/krun/pkg/ca"
+	"github.com/costinm/krun/pkg/logs"
+)
+
+var logger = logs.New("certs")
+
+// Renewer keeps a workload certificate fresh, re-signing the same key before
+// the cert expires.
+type Renewer struct {
+	Signer ca.Signer
+
+	// PrivPEM and CSR are reused for all renewals.
+	PrivPEM []byte
+	CSR     []byte
+
+	// TTL is the requested lifetime.
+	TTL time.Duration
+
+	// RenewFraction of the lifetime after which the cert is renewed. Default 0.5
+	RenewFraction float64
+
+	// MinBackoff and MaxBackoff bound the retry interval after a failed signing.
+	// Defaults 1s and 5m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnCert is called with each new chain.
+	OnCert func(priv []byte, chain []string) error
+
+	m        sync.RWMutex
+	chain    []string
+	leaf     *x509.Certificate
+	next     time.Time
+	lastErr  error
+	failures int
+}
+
+// Renew signs the CSR and calls OnCert. Returns the time of the next renewal.
+func (r *Renewer) Renew(ctx context.Context) (time.Time, error) {
+	chain, err := r.Signer.CSRSign(ctx, r.CSR, int64(r.TTL.Seconds()))
+	if err == nil && len(chain) == 0 {
+		err = errors.New("empty cert chain")
+	}
+	var leaf *x509.Certificate
+	if err == nil {
+		leaf, err = ParseLeaf(chain)
+	}
+	if err == nil {
+		err = ca.CheckKey(r.PrivPEM, leaf)
+	}
+	if err == nil && r.OnCert != nil {
+		err = r.OnCert(r.PrivPEM, chain)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err != nil {
+		r.failures++
+		r.lastErr = err
+		r.next = time.Now().Add(r.backoff())
+		// Don't wait past expiry if we have a cert.
+		if r.leaf != nil && r.next.After(r.leaf.NotAfter) {
+			r.next = r.leaf.NotAfter
+		}
+		return r.next, err
+	}
+	r.failures = 0
+	r.lastErr = nil
+	r.chain = chain
+	r.leaf = leaf
+	r.next = renewTime(leaf, r.RenewFraction)
+	return r.next, nil
+}
+
+// Run renews the certificate until the context is done. The first renewal
+// happens immediately, unless a cert was already provisioned.
+func (r *Renewer) Run(ctx context.Context) {
+	for {
+		r.m.RLock()
+		next := r.next
+		r.m.RUnlock()
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		next, err := r.Renew(ctx)
+		if err != nil {
+			logger.Warn("Certificate renewal failed", "retry", next, "error", err)
+		} else {
+			logger.Info("Certificate renewed", "nextRenewal", next)
+		}
+	}
+}
+
+// NextRenewal returns the time when the cert will be renewed.
+func (r *Renewer) NextRenewal() time.Time {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.next
+}
+
+// Leaf returns the current workload certificate, or nil.
+func (r *Renewer) Leaf() *x509.Certificate {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.leaf
+}
+
+// LastError returns the error of the last renewal attempt.
+func (r *Renewer) LastError() error {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.lastErr
+}
+
+// backoff returns the jittered retry interval for the current failure count.
+func (r *Renewer) backoff() time.Duration {
+	min := r.MinBackoff
+	if min == 0 {
+		min = time.Second
+	}
+	max := r.MaxBackoff
+	if max == 0 {
+		max = 5 * time.Minute
+	}
+	d := min
+	for i := 1; i < r.failures && d < max; i++ {
+		d = d * 2
+	}
+	if d > max {
+		d = max
+	}
+	// +/- 20%
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+// renewTime returns the time when fraction of the cert lifetime has elapsed.
+func renewTime(leaf *x509.Certificate, fraction float64) time.Time {
+	if fraction <= 0 || fraction >= 1 {
+		fraction = 0.5
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+// ParseLeaf parses the first cert in a PEM chain.
+func ParseLeaf(chain []string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(chain[0]))
+	if block == nil {
+		return nil, errors.New("invalid PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+// testSigner signs with a local CA, failing while err is set.
+type testSigner struct {
+	ca *ca.LocalCA
+
+	m     sync.Mutex
+	err   error
+	calls int
+}
+
+func (s *testSigner) CSRSign(ctx context.Context, csrPEM []byte, ttl int64) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.ca.CSRSign(ctx, csrPEM, ttl)
+}
+
+func (s *testSigner) setErr(err error) {
+	s.m.Lock()
+	s.err = err
+	s.m.Unlock()
+}
+
+func (s *testSigner) count() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.calls
+}
+
+func newTestRenewer(t *testing.T) (*Renewer, *testSigner) {
+	dir, _ := ioutil.TempDir("", "renew-ca")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	local, err := ca.NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, csr, err := ca.NewCSR(ca.KeyECDSAP256, "cluster.local", "spiffe://cluster.local/ns/test/sa/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSigner{ca: local}
+	return &Renewer{Signer: s, PrivPEM: priv, CSR: csr, TTL: time.Hour}, s
+}
+
+func TestRenewTime(t *testing.T) {
+	now := time.Now()
+	leaf := &x509.Certificate{NotBefore: now, NotAfter: now.Add(100 * time.Minute)}
+	for fraction, want := range map[float64]time.Duration{
+		0:    50 * time.Minute,
+		0.8:  80 * time.Minute,
+		1:    50 * time.Minute,
+		-0.5: 50 * time.Minute,
+	} {
+		if got := renewTime(leaf, fraction); !got.Equal(now.Add(want)) {
+			t.Errorf("%v: got %v, expecting %v", fraction, got.Sub(now), want)
+		}
+	}
+}
+
+func TestRenew(t *testing.T) {
+	ctx := context.Background()
+	r, s := newTestRenewer(t)
+	r.RenewFraction = 0.8
+	var got []string
+	r.OnCert = func(priv []byte, chain []string) error {
+		got = chain
+		return nil
+	}
+
+	next, err := r.Renew(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := r.Leaf()
+	if leaf == nil || len(got) == 0 {
+		t.Fatal("no cert")
+	}
+	if !next.Equal(renewTime(leaf, 0.8)) || !r.NextRenewal().Equal(next) {
+		t.Errorf("unexpected next renewal %v", next)
+	}
+
+	// A failed renewal keeps the cert, and is retried before it expires.
+	s.setErr(errors.New("unavailable"))
+	r.MinBackoff, r.MaxBackoff = 2*time.Hour, 4*time.Hour
+	next, err = r.Renew(ctx)
+	if err == nil || r.LastError() == nil || r.Leaf() != leaf {
+		t.Fatalf("unexpected state after failure %v", err)
+	}
+	if !next.Equal(leaf.NotAfter) {
+		t.Errorf("retry %v after expiry %v", next, leaf.NotAfter)
+	}
+
+	// OnCert errors are failures.
+	s.setErr(nil)
+	r.OnCert = func(priv []byte, chain []string) error { return errors.New("write failed") }
+	if _, err = r.Renew(ctx); err == nil || r.failures != 2 {
+		t.Errorf("OnCert error ignored %v %d", err, r.failures)
+	}
+
+	r.OnCert = nil
+	if _, err = r.Renew(ctx); err != nil || r.LastError() != nil || r.failures != 0 {
+		t.Errorf("failures not reset %v %d", err, r.failures)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := &Renewer{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for failures, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		r.failures = failures
+		for i := 0; i < 20; i++ {
+			if d := r.backoff(); d < want*8/10 || d > want*12/10 {
+				t.Errorf("%d failures: got %v, expecting %v +/- 20%%", failures, d, want)
+			}
+		}
+	}
+	r = &Renewer{failures: 1}
+	if d := r.backoff(); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+		t.Errorf("default min backoff: got %v", d)
+	}
+}
+
+func TestRun(t *testing.T) {
+	r, s := newTestRenewer(t)
+	s.setErr(errors.New("unavailable"))
+	r.MinBackoff, r.MaxBackoff = 10*time.Millisecond, 20*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+
+	// The first renewal is immediate, failures are retried with the backoff.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.setErr(nil)
+	for r.Leaf() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if r.Leaf() == nil {
+		t.Fatalf("not renewed after %d attempts: %v", s.count(), r.LastError())
+	}
+
+	// The next renewal is at half the lifetime - no more attempts until then.
+	n := s.count()
+	time.Sleep(50 * time.Millisecond)
+	if s.count() != n {
+		t.Errorf("renewed before %v", r.NextRenewal())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+}
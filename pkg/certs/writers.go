@@ -0,0 +1,273 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/costinm/krun/pkg/ca"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// IstioCertDir is the default location of the certificates in the Istio layout.
+const IstioCertDir = "/var/run/secrets/istio"
+
+// Writer saves the private key, the cert chain and the roots in a specific layout.
+type Writer func(priv []byte, chain []string, roots string) error
+
+// WriterOptions configure the output.
+type WriterOptions struct {
+	// Dir is the output directory. If empty, the default for the format is used.
+	Dir string
+
+	// Name and Namespace of the Kubernetes Secret.
+	Name      string
+	Namespace string
+
+	// Password for the PKCS#12 bundle.
+	Password string
+
+	// KeyProtector encrypts the private key at rest, if set. The PKCS#12 bundle is protected by
+	// the password instead.
+	KeyProtector ca.KeyProtector
+}
+
+// writers create the Writer for a format - the format name selects the default dir.
+var writers = map[string]func(format string, opts *WriterOptions) Writer{
+	"workload": workloadWriter,
+	"istio":    chainKeyRootWriter,
+	"spiffe":   chainKeyRootWriter,
+	"k8s":      secretWriter,
+	"pkcs12":   pkcs12Writer,
+}
+
+// Formats returns the supported output formats.
+func Formats() []string {
+	res := []string{}
+	for k := range writers {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// NewWriter returns the writer for a comma separated list of formats:
+//
+// - workload - certificates.pem, private_key.pem, ca_certificates.pem, default in WorkloadCertDir
+// - istio - cert-chain.pem, key.pem, root-cert.pem, default in IstioCertDir
+// - spiffe - cert-chain.pem, key.pem, root-cert.pem, default in WorkloadCertDir
+// - k8s - a kubernetes.io/tls Secret manifest, NAME.yaml, default in the current dir
+// - pkcs12 - a password protected keystore.p12 with the key and chain, for JVM apps
+//
+// If opts.KeyProtector is set, the key is saved encrypted, except in the pkcs12 format. The k8s
+// format can't be used with a KeyProtector - the consumers of kubernetes.io/tls Secrets expect a plain key.
+func NewWriter(formats string, opts *WriterOptions) (Writer, error) {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	res := []Writer{}
+	for _, f := range strings.Split(formats, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		nw, ok := writers[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown output format %q, expecting %s", f, strings.Join(Formats(), ", "))
+		}
+		if f == "pkcs12" && opts.Password == "" {
+			return nil, errors.New("pkcs12 output requires a password")
+		}
+		if f == "k8s" && opts.KeyProtector != nil {
+			return nil, errors.New("k8s output can't use a key-encryption-key, the Secret requires the plain key")
+		}
+		res = append(res, nw(f, opts))
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no output format")
+	}
+	return func(priv []byte, chain []string, roots string) error {
+		for _, w := range res {
+			if err := w(priv, chain, roots); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+var defaultDirs = map[string]string{
+	"workload": WorkloadCertDir,
+	"istio":    IstioCertDir,
+	"spiffe":   WorkloadCertDir,
+	"k8s":      ".",
+	"pkcs12":   WorkloadCertDir,
+}
+
+// DirFor returns the output directory for a format.
+func (opts *WriterOptions) DirFor(format string) string {
+	if opts.Dir != "" {
+		return opts.Dir
+	}
+	return defaultDirs[format]
+}
+
+func workloadWriter(format string, opts *WriterOptions) Writer {
+	return func(priv []byte, chain []string, roots string) error {
+		priv, err := ca.EncryptKey(opts.KeyProtector, priv)
+		if err != nil {
+			return err
+		}
+		return SaveWorkloadCerts(opts.DirFor(format), priv, chain, roots)
+	}
+}
+
+// chainKeyRootWriter saves the Istio file names, used by the istio and spiffe formats.
+func chainKeyRootWriter(format string, opts *WriterOptions) Writer {
+	return func(priv []byte, chain []string, roots string) error {
+		priv, err := ca.EncryptKey(opts.KeyProtector, priv)
+		if err != nil {
+			return err
+		}
+		return saveChainKeyRoot(opts.DirFor(format), priv, chain, roots)
+	}
+}
+
+// saveChainKeyRoot writes cert-chain.pem, key.pem and root-cert.pem.
+func saveChainKeyRoot(dir string, priv []byte, chain []string, roots string) error {
+	if roots != "" {
+		err := WriteFile(filepath.Join(dir, "root-cert.pem"), []byte(roots), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	err := WriteFile(filepath.Join(dir, "key.pem"), priv, 0600)
+	if err != nil {
+		return err
+	}
+	return WriteFile(filepath.Join(dir, "cert-chain.pem"), []byte(JoinPEM(chain)), 0644)
+}
+
+// SecretTemplate is a Kubernetes TLS Secret with the workload certificates.
+const SecretTemplate = `apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ .name }}
+{{- if .namespace }}
+  namespace: {{ .namespace }}
+{{- end }}
+type: kubernetes.io/tls
+data:
+  tls.crt: {{ .crt }}
+  tls.key: {{ .key }}
+{{- if .ca }}
+  ca.crt: {{ .ca }}
+{{- end }}
+`
+
+var secretTmpl = template.Must(template.New("secret").Parse(SecretTemplate))
+
+func secretWriter(format string, opts *WriterOptions) Writer {
+	return func(priv []byte, chain []string, roots string) error {
+		name := opts.Name
+		if name == "" {
+			name = "workload-certs"
+		}
+		buf := &bytes.Buffer{}
+		err := secretTmpl.Execute(buf, map[string]string{
+			"name":      name,
+			"namespace": opts.Namespace,
+			"crt":       base64.StdEncoding.EncodeToString([]byte(JoinPEM(chain))),
+			"key":       base64.StdEncoding.EncodeToString(priv),
+			"ca":        base64.StdEncoding.EncodeToString([]byte(roots)),
+		})
+		if err != nil {
+			return err
+		}
+		// The manifest includes the private key.
+		return WriteFile(filepath.Join(opts.DirFor(format), name+".yaml"), buf.Bytes(), 0600)
+	}
+}
+
+func pkcs12Writer(format string, opts *WriterOptions) Writer {
+	return func(priv []byte, chain []string, roots string) error {
+		key, err := ca.ParsePrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		certs, err := ParseCerts(JoinPEM(chain))
+		if err != nil {
+			return err
+		}
+		if len(certs) == 0 {
+			return errors.New("empty cert chain")
+		}
+		cas := certs[1:]
+		rootCerts, err := ParseCerts(roots)
+		if err != nil {
+			return err
+		}
+		for _, r := range rootCerts {
+			if !containsCert(cas, r) {
+				cas = append(cas, r)
+			}
+		}
+		p12, err := pkcs12.Encode(rand.Reader, key, certs[0], cas, opts.Password)
+		if err != nil {
+			return err
+		}
+		return WriteFile(filepath.Join(opts.DirFor(format), "keystore.p12"), p12, 0600)
+	}
+}
+
+// ParseCerts parses all the certificates in a PEM string.
+func ParseCerts(pems string) ([]*x509.Certificate, error) {
+	res := []*x509.Certificate{}
+	rest := []byte(pems)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return res, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+}
+
+func containsCert(certs []*x509.Certificate, c *x509.Certificate) bool {
+	for _, e := range certs {
+		if e.Equal(c) {
+			return true
+		}
+	}
+	return false
+}
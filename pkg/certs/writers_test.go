@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/costinm/krun/pkg/ca"
+)
+
+func TestWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lca, err := ca.NewLocalCA(filepath.Join(dir, "ca"), "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, csr, err := ca.NewCSR(ca.KeyECDSAP256, "cluster.local", "spiffe://cluster.local/ns/test/sa/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := lca.CSRSign(context.Background(), csr, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := ca.NewKeyProtector("localkms://" + filepath.Join(dir, "kms"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		formats string
+		opts    *WriterOptions
+	}{
+		{"k8s", &WriterOptions{KeyProtector: kp}},
+		{"istio,k8s", &WriterOptions{KeyProtector: kp}},
+		{"pkcs12", &WriterOptions{}},
+		{"pem", &WriterOptions{}},
+		{" , ", &WriterOptions{}},
+	} {
+		if _, err := NewWriter(tc.formats, tc.opts); err == nil {
+			t.Errorf("%q: expecting error", tc.formats)
+		}
+	}
+
+	// The key in the Secret is not encrypted.
+	w, err := NewWriter("k8s", &WriterOptions{Dir: dir, Name: "certs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w(priv, chain, chain[1]); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ioutil.ReadFile(filepath.Join(dir, "certs.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(secret, []byte("tls.key: "+base64.StdEncoding.EncodeToString(priv))) {
+		t.Error("plain key not found in the Secret")
+	}
+
+	// The istio and spiffe formats save the same files, with the key encrypted.
+	for _, f := range []string{"istio", "spiffe"} {
+		out := filepath.Join(dir, f)
+		w, err := NewWriter(f, &WriterOptions{Dir: out, KeyProtector: kp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w(priv, chain, chain[1]); err != nil {
+			t.Fatal(err)
+		}
+		saved, _ := ioutil.ReadFile(filepath.Join(out, "key.pem"))
+		if bytes.Equal(saved, priv) {
+			t.Errorf("%s: key saved in plain text", f)
+		}
+		p2, c2, roots, err := LoadCerts(out, kp)
+		if err != nil {
+			t.Fatal(f, err)
+		}
+		if !bytes.Equal(p2, priv) || len(c2) != 2 || roots != chain[1] {
+			t.Errorf("%s: loaded certs don't match", f)
+		}
+	}
+}
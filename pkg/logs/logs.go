@@ -0,0 +1,254 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logs is a minimal structured logger, writing one JSON object per line using the
+// Cloud Logging field names (severity, message, time), so CloudRun and GKE log agents parse the level.
+//
+// The level is set with LOG_LEVEL (debug, info, warning, error), default info.
+// Values for keys that look like secrets, and strings that look like tokens, are redacted.
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the log severity.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+// String returns the Cloud Logging severity name.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelWarning:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	}
+	return "INFO"
+}
+
+// ParseLevel parses a level name, as used in LOG_LEVEL.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q", s)
+}
+
+var (
+	mutex sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = LevelInfo
+)
+
+func init() {
+	if l, err := ParseLevel(os.Getenv("LOG_LEVEL")); err == nil {
+		level = l
+	}
+}
+
+// SetLevel changes the minimum level.
+func SetLevel(l Level) {
+	mutex.Lock()
+	level = l
+	mutex.Unlock()
+}
+
+// SetOutput changes the destination, default stderr.
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	out = w
+	mutex.Unlock()
+}
+
+// Logger writes the entries of a component.
+type Logger struct {
+	Component string
+}
+
+// New returns a logger tagging the entries with the component name.
+func New(component string) *Logger {
+	return &Logger{Component: component}
+}
+
+// Debug logs a message, with key/value pairs.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.Log(LevelDebug, msg, kv...)
+}
+
+// Info logs a message, with key/value pairs.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.Log(LevelInfo, msg, kv...)
+}
+
+// Warn logs a message, with key/value pairs.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.Log(LevelWarning, msg, kv...)
+}
+
+// Error logs a message, with key/value pairs.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.Log(LevelError, msg, kv...)
+}
+
+// Fatal logs an error and exits with code 1.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.Log(LevelError, msg, kv...)
+	os.Exit(1)
+}
+
+// Log writes an entry if the level is enabled. kv is a list of key, value pairs.
+func (l *Logger) Log(lvl Level, msg string, kv ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if lvl < level {
+		return
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString(`{"severity":"`)
+	b.WriteString(lvl.String())
+	b.WriteString(`","time":"`)
+	b.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`"`)
+	if l.Component != "" {
+		writeField(b, "component", l.Component)
+	}
+	writeField(b, "message", RedactString(msg))
+	for i := 0; i < len(kv); i += 2 {
+		k := fmt.Sprint(kv[i])
+		if i+1 == len(kv) {
+			writeField(b, "extra", Redact(k, kv[i]))
+			break
+		}
+		if k == "severity" || k == "time" || k == "message" || k == "component" {
+			k = "_" + k
+		}
+		writeField(b, k, Redact(k, kv[i+1]))
+	}
+	b.WriteString("}\n")
+	out.Write(b.Bytes())
+}
+
+func writeField(b *bytes.Buffer, k string, v interface{}) {
+	kb, _ := json.Marshal(k)
+	vb, err := json.Marshal(v)
+	if err != nil {
+		vb, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.WriteByte(',')
+	b.Write(kb)
+	b.WriteByte(':')
+	b.Write(vb)
+}
+
+// StdLog redirects the standard library logger - used by dependencies - to l, at info level.
+func StdLog(l *Logger) {
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{l})
+}
+
+type stdWriter struct {
+	l *Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	w.l.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	sensitiveKeys = []string{"token", "password", "passwd", "secret", "authorization", "credential",
+		"private", "apikey", "api_key", "cookie"}
+
+	// JWTs and bearer tokens, as found in errors and URLs.
+	tokenRE = regexp.MustCompile(`(eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*)|((?i:bearer)\s+[A-Za-z0-9._~+/=-]+)|(ya29\.[A-Za-z0-9._-]+)`)
+)
+
+// IsSensitive returns true if the key or env variable name is likely to hold a secret.
+func IsSensitive(key string) bool {
+	k := strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns the value to log for a key - hidden if the key is sensitive, strings and errors
+// with the tokens removed.
+func Redact(key string, v interface{}) interface{} {
+	if IsSensitive(key) {
+		return redacted
+	}
+	switch vv := v.(type) {
+	case string:
+		return RedactString(vv)
+	case error:
+		return RedactString(vv.Error())
+	case time.Time:
+		return vv
+	case fmt.Stringer:
+		return RedactString(vv.String())
+	}
+	return v
+}
+
+// RedactString removes the tokens from s.
+func RedactString(s string) string {
+	return tokenRE.ReplaceAllString(s, redacted)
+}
+
+// RedactEnv returns a copy of the environment - in KEY=VALUE form - with the values of sensitive
+// variables hidden.
+func RedactEnv(env []string) []string {
+	res := make([]string, 0, len(env))
+	for _, kv := range env {
+		kvs := strings.SplitN(kv, "=", 2)
+		if len(kvs) == 2 && IsSensitive(kvs[0]) {
+			res = append(res, kvs[0]+"="+redacted)
+			continue
+		}
+		res = append(res, RedactString(kv))
+	}
+	return res
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const jwt = "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ4In0.c2ln"
+
+func TestRedact(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		key  string
+		v    interface{}
+		want interface{}
+	}{
+		{"token", "abc", redacted},
+		{"ID_TOKEN", "abc", redacted},
+		{"dbPassword", 1, redacted},
+		{"Authorization", "Bearer x", redacted},
+		{"url", "https://x/?t=" + jwt, "https://x/?t=" + redacted},
+		{"header", "got Bearer abc.def from", "got " + redacted + " from"},
+		{"access", "ya29.a0AfH6SMB-x_y", redacted},
+		{"error", errors.New("invalid " + jwt), "invalid " + redacted},
+		{"count", 3, 3},
+		{"addr", "127.0.0.1:15009", "127.0.0.1:15009"},
+		{"time", now, now},
+	} {
+		if got := Redact(tc.key, tc.v); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s=%v: got %v, want %v", tc.key, tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestRedactEnv(t *testing.T) {
+	got := RedactEnv([]string{"HOME=/root", "GITHUB_TOKEN=abc", "ARGS=--auth=Bearer abc", "NOVALUE"})
+	want := []string{"HOME=/root", "GITHUB_TOKEN=" + redacted, "ARGS=--auth=" + redacted, "NOVALUE"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLog(t *testing.T) {
+	b := &bytes.Buffer{}
+	SetOutput(b)
+	defer SetOutput(os.Stderr)
+	SetLevel(LevelInfo)
+
+	l := New("test")
+	l.Debug("hidden")
+	l.Warn("token "+jwt, "secret", "s", "message", "m", "odd")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expecting one entry, got %q", b.String())
+	}
+	e := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"severity":  "WARNING",
+		"component": "test",
+		"message":   "token " + redacted,
+		"secret":    redacted,
+		"_message":  "m",
+		"extra":     "odd",
+	} {
+		if e[k] != v {
+			t.Errorf("%s: got %v, want %v", k, e[k], v)
+		}
+	}
+}
@@ -16,8 +16,17 @@ package cas
 
 import (
 	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	privateca "cloud.google.com/go/security/privateca/apiv1"
@@ -25,13 +34,27 @@ import (
 	privatecapb "google.golang.org/genproto/googleapis/cloud/security/privateca/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/durationpb"
-	"k8s.io/apimachinery/pkg/util/rand"
 )
 
 // GoogleCASClient: Agent side plugin for Google CAS
 type GoogleCASClient struct {
 	caSigner string
 	caClient *privateca.CertificateAuthorityClient
+	opts     Options
+}
+
+// Options for the requested certificates.
+type Options struct {
+	// SpiffeID is the workload identity. If ReflectedSpiffe is false, it is set explicitly as URI SAN,
+	// which requires the privateca.certificates.create permission. It is also used for the certificate ID.
+	SpiffeID string
+
+	// ReflectedSpiffe uses the REFLECTED_SPIFFE subject mode - CAS infers the identity from the caller,
+	// which must have a SPIFFE identity (privateca.certificates.createForSelf).
+	ReflectedSpiffe bool
+
+	// Template is the optional certificate template - projects/*/locations/*/certificateTemplates/*.
+	Template string
 }
 
 // CAS is defined as grpc service in https://github.com/googleapis/go-genproto/blob/main/googleapis/cloud/security/privateca/v1/service.pb.go
@@ -40,8 +63,11 @@ type GoogleCASClient struct {
 
 // NewGoogleCASClient create a CA client for Google CAS.
 // capool is in format: projects/*/locations/*/caPools/*
-func NewGoogleCASClient(capool string, ol []grpc.DialOption) (*GoogleCASClient, error) {
+func NewGoogleCASClient(capool string, opts *Options, ol []grpc.DialOption) (*GoogleCASClient, error) {
 	caClient := &GoogleCASClient{caSigner: capool}
+	if opts != nil {
+		caClient.opts = *opts
+	}
 	ctx := context.Background()
 	var err error
 
@@ -59,26 +85,70 @@ func NewGoogleCASClient(capool string, ol []grpc.DialOption) (*GoogleCASClient,
 	return caClient, nil
 }
 
-func (r *GoogleCASClient) createCertReq(name string, csrPEM []byte, lifetime time.Duration) *privatecapb.CreateCertificateRequest {
+// publicKeyPEM returns the PEM encoded public key of the CSR, as expected by CAS.
+func publicKeyPEM(csrPEM []byte) ([]byte, crypto.PublicKey, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("invalid PEM CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), csr.PublicKey, nil
+}
+
+func (r *GoogleCASClient) createCertReq(name string, csrPEM []byte, lifetime time.Duration) (*privatecapb.CreateCertificateRequest, error) {
 	var isCA bool = false
 
+	pubPEM, pub, err := publicKeyPEM(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	// Key encipherment is only valid for RSA keys.
+	_, isRSA := pub.(*rsa.PublicKey)
+
+	// With REFLECTED_SPIFFE, CAS infers the certificate SAN (identity) of the workload from the caller identity.
+	// Otherwise the SPIFFE URI is set explicitly.
+	subjectMode := privatecapb.SubjectRequestMode_DEFAULT
+	subject := &privatecapb.CertificateConfig_SubjectConfig{
+		Subject: &privatecapb.Subject{},
+	}
+	if r.opts.ReflectedSpiffe {
+		subjectMode = privatecapb.SubjectRequestMode_REFLECTED_SPIFFE
+	} else {
+		spiffeID := r.opts.SpiffeID
+		if spiffeID == "" {
+			spiffeID, err = csrSpiffeID(csrPEM)
+			if err != nil {
+				return nil, err
+			}
+		}
+		subject.SubjectAltName = &privatecapb.SubjectAltNames{
+			Uris: []string{spiffeID},
+		}
+	}
+
 	// We use Certificate_Config option to ensure that we only request a certificate with CAS supported extensions/usages.
-	// CAS uses the PEM encoded CSR only for its public key and infers the certificate SAN (identity) of the workload through SPIFFE identity reflection
+	// CAS uses only the public key from the CSR.
 	creq := &privatecapb.CreateCertificateRequest{
 		Parent:        r.caSigner,
 		CertificateId: name,
 		Certificate: &privatecapb.Certificate{
-			Lifetime: durationpb.New(lifetime),
+			Lifetime:            durationpb.New(lifetime),
+			CertificateTemplate: r.opts.Template,
 			CertificateConfig: &privatecapb.Certificate_Config{
 				Config: &privatecapb.CertificateConfig{
-					SubjectConfig: &privatecapb.CertificateConfig_SubjectConfig{
-						Subject: &privatecapb.Subject{},
-					},
+					SubjectConfig: subject,
 					X509Config: &privatecapb.X509Parameters{
 						KeyUsage: &privatecapb.KeyUsage{
 							BaseKeyUsage: &privatecapb.KeyUsage_KeyUsageOptions{
 								DigitalSignature: true,
-								KeyEncipherment:  true,
+								KeyEncipherment:  isRSA,
 							},
 							ExtendedKeyUsage: &privatecapb.KeyUsage_ExtendedKeyUsageOptions{
 								ServerAuth: true,
@@ -91,26 +161,86 @@ func (r *GoogleCASClient) createCertReq(name string, csrPEM []byte, lifetime tim
 					},
 					PublicKey: &privatecapb.PublicKey{
 						Format: privatecapb.PublicKey_PEM,
-						Key:    csrPEM,
+						Key:    pubPEM,
 					},
 				},
 			},
-			SubjectMode: privatecapb.SubjectRequestMode_REFLECTED_SPIFFE,
+			SubjectMode: subjectMode,
 		},
 	}
-	return creq
+	return creq, nil
+}
+
+// csrSpiffeID returns the SPIFFE URI SAN of the CSR.
+func csrSpiffeID(csrPEM []byte) (string, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return "", fmt.Errorf("invalid PEM CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	for _, u := range csr.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("CSR has no SPIFFE URI")
+}
+
+// certID returns a certificate ID derived from the workload identity: NAMESPACE-KSA-TIME-KEYHASH.
+// The ID must be unique in the pool - the time and key hash distinguish the renewals and instances.
+func (r *GoogleCASClient) certID(csrPEM []byte) (string, error) {
+	pubPEM, _, err := publicKeyPEM(csrPEM)
+	if err != nil {
+		return "", err
+	}
+	id := r.opts.SpiffeID
+	if id == "" {
+		id, _ = csrSpiffeID(csrPEM)
+	}
+	prefix := "workload"
+	if u, err := url.Parse(id); err == nil {
+		// /ns/NAMESPACE/sa/KSA
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) == 4 {
+			prefix = parts[1] + "-" + parts[3]
+		}
+	}
+	sum := sha256.Sum256(pubPEM)
+	suffix := "-" + strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36) + "-" + hex.EncodeToString(sum[:4])
+	prefix = sanitizeID(prefix)
+	// IDs are limited to 63 chars.
+	if len(prefix)+len(suffix) > 63 {
+		prefix = prefix[:63-len(suffix)]
+	}
+	return prefix + suffix, nil
+}
+
+// sanitizeID keeps the characters allowed in a certificate ID - letters, digits, '-' and '_'.
+func sanitizeID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, s)
 }
 
 // CSR Sign calls Google CAS to sign a CSR.
-func (r *GoogleCASClient) CSRSign(csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+func (r *GoogleCASClient) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
 	certChain := []string{}
 
-	rand.Seed(time.Now().UnixNano())
-	// TODO: use location, pod identity
-	name := fmt.Sprintf("csr-workload-%s", rand.String(8))
-	creq := r.createCertReq(name, csrPEM, time.Duration(certValidTTLInSec)*time.Second)
-
-	ctx := context.Background()
+	name, err := r.certID(csrPEM)
+	if err != nil {
+		return []string{}, err
+	}
+	creq, err := r.createCertReq(name, csrPEM, time.Duration(certValidTTLInSec)*time.Second)
+	if err != nil {
+		return []string{}, err
+	}
 
 	cresp, err := r.caClient.CreateCertificate(ctx, creq)
 	if err != nil {
@@ -123,13 +253,11 @@ func (r *GoogleCASClient) CSRSign(csrPEM []byte, certValidTTLInSec int64) ([]str
 }
 
 // GetRootCertBundle:  Get CA certs of the pool from Google CAS API endpoint
-func (r *GoogleCASClient) GetRootCertBundle() ([]string, error) {
+func (r *GoogleCASClient) GetRootCertBundle(ctx context.Context) ([]string, error) {
 	var rootCertMap map[string]struct{} = make(map[string]struct{})
 	var trustbundle []string = []string{}
 	var err error
 
-	ctx := context.Background()
-
 	req := &privatecapb.FetchCaCertsRequest{
 		CaPool: r.caSigner,
 	}
@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	privatecapb "google.golang.org/genproto/googleapis/cloud/security/privateca/v1"
+)
+
+func newCSR(t *testing.T, key crypto.Signer, san string) []byte {
+	tmpl := &x509.CertificateRequest{}
+	if san != "" {
+		u, _ := url.Parse(san)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestCertID(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	long := strings.Repeat("n", 60)
+	for _, tc := range []struct {
+		spiffeID string
+		csrSAN   string
+		prefix   string
+	}{
+		{"spiffe://cluster.local/ns/fortio/sa/default", "", "fortio-default"},
+		{"", "spiffe://cluster.local/ns/test/sa/my.sa", "test-my-sa"},
+		{"", "", "workload"},
+		{"spiffe://td/other", "", "workload"},
+		{"spiffe://td/ns/" + long + "/sa/default", "", long[:63-len("-XXXXXXXX-12345678")]},
+	} {
+		c := &GoogleCASClient{opts: Options{SpiffeID: tc.spiffeID}}
+		id, err := c.certID(newCSR(t, key, tc.csrSAN))
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(tc.prefix) + "-[0-9a-z]+-[0-9a-f]{8}$")
+		if !re.MatchString(id) || len(id) > 63 {
+			t.Errorf("%s %s: unexpected ID %s, expecting prefix %s", tc.spiffeID, tc.csrSAN, id, tc.prefix)
+		}
+	}
+
+	// Different keys for the same identity - instances or renewals with a new key - get different IDs.
+	c := &GoogleCASClient{opts: Options{SpiffeID: "spiffe://cluster.local/ns/fortio/sa/default"}}
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id1, _ := c.certID(newCSR(t, key, ""))
+	id2, _ := c.certID(newCSR(t, key2, ""))
+	if id1[len(id1)-8:] == id2[len(id2)-8:] {
+		t.Errorf("same key hash for different keys: %s %s", id1, id2)
+	}
+
+	if _, err := c.certID([]byte("invalid")); err == nil {
+		t.Error("expecting error for invalid CSR")
+	}
+}
+
+func TestCreateCertReq(t *testing.T) {
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	id := "spiffe://cluster.local/ns/fortio/sa/default"
+
+	c := &GoogleCASClient{caSigner: "projects/p/locations/l/caPools/istio"}
+	req, err := c.createCertReq("n", newCSR(t, ec, id), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := req.Certificate.GetConfig()
+	if got := cfg.SubjectConfig.SubjectAltName.GetUris(); len(got) != 1 || got[0] != id {
+		t.Errorf("SAN from CSR: got %v", got)
+	}
+	if cfg.X509Config.KeyUsage.BaseKeyUsage.KeyEncipherment {
+		t.Error("key encipherment set for ECDSA key")
+	}
+	if req.Parent != c.caSigner || req.CertificateId != "n" || req.Certificate.Lifetime.AsDuration() != time.Hour {
+		t.Errorf("unexpected request %v", req)
+	}
+
+	req, err = c.createCertReq("n", newCSR(t, rk, id), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.Certificate.GetConfig().X509Config.KeyUsage.BaseKeyUsage.KeyEncipherment {
+		t.Error("key encipherment not set for RSA key")
+	}
+
+	c.opts.ReflectedSpiffe = true
+	req, _ = c.createCertReq("n", newCSR(t, ec, ""), time.Hour)
+	if req.Certificate.SubjectMode != privatecapb.SubjectRequestMode_REFLECTED_SPIFFE ||
+		req.Certificate.GetConfig().SubjectConfig.SubjectAltName != nil {
+		t.Errorf("reflected mode: unexpected request %v", req)
+	}
+
+	c.opts.ReflectedSpiffe = false
+	if _, err := c.createCertReq("n", newCSR(t, ec, ""), time.Hour); err == nil {
+		t.Error("expecting error for CSR without SPIFFE ID")
+	}
+}
@@ -53,7 +53,12 @@ type Options struct {
 	// exchanged with the workload certificate.
 	// It is a cert signed by same CA (or a CA trusted by Istiod).
 	// It is still exchanged because Istiod may add info to the cert.
+	// If TokenProvider is nil, the cert is the only authentication.
 	ProvCert string
+
+	// LoadProvCert replaces loading cert-chain.pem and key.pem from the ProvCert dir - for example
+	// to decrypt the key.
+	LoadProvCert func(dir string) (tls.Certificate, error)
 }
 
 type CitadelClient struct {
@@ -87,7 +92,7 @@ func (c *CitadelClient) Close() {
 }
 
 // CSR Sign calls Citadel to sign a CSR.
-func (c *CitadelClient) CSRSign(csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+func (c *CitadelClient) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
 	crMetaStruct := &Struct{
 		Fields: map[string]*Value{
 			CertSigner: {
@@ -100,7 +105,7 @@ func (c *CitadelClient) CSRSign(csrPEM []byte, certValidTTLInSec int64) ([]strin
 		ValidityDuration: certValidTTLInSec,
 		Metadata:         crMetaStruct,
 	}
-	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("ClusterID", c.opts.ClusterID))
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("ClusterID", c.opts.ClusterID))
 	resp, err := c.client.CreateCertificate(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("create certificate: %v", err)
@@ -132,19 +137,30 @@ func (c *CitadelClient) getTLSDialOption() (grpc.DialOption, error) {
 		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
 			if c.opts.ProvCert != "" {
 				// Load the certificate from disk
-				certificate, err = tls.LoadX509KeyPair(
-					filepath.Join(c.opts.ProvCert, "cert-chain.pem"),
-					filepath.Join(c.opts.ProvCert, "key.pem"))
+				if c.opts.LoadProvCert != nil {
+					certificate, err = c.opts.LoadProvCert(c.opts.ProvCert)
+				} else {
+					certificate, err = tls.LoadX509KeyPair(
+						filepath.Join(c.opts.ProvCert, "cert-chain.pem"),
+						filepath.Join(c.opts.ProvCert, "key.pem"))
+				}
 
 				if err != nil {
+					if c.opts.TokenProvider == nil {
+						return nil, fmt.Errorf("cannot load provisioning cert: %v", err)
+					}
 					// we will return an empty cert so that when user sets the Prov cert path
 					// but not have such cert in the file path we use the token to provide verification
 					// instead of just broken the workflow
 					log.Printf("cannot load key pair, using token instead: %v", err)
 					return &certificate, nil
 				}
-				if certificate.Leaf.NotAfter.Before(time.Now()) {
-					log.Printf("cannot parse the cert chain, using token instead: %v", err)
+				leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+				if err != nil || leaf.NotAfter.Before(time.Now()) {
+					if c.opts.TokenProvider == nil {
+						return nil, fmt.Errorf("expired or invalid provisioning cert %v", err)
+					}
+					log.Printf("expired or invalid provisioning cert, using token instead: %v", err)
 					return &tls.Certificate{}, nil
 				}
 			}
@@ -180,7 +196,9 @@ func (c *CitadelClient) buildConnection() (*grpc.ClientConn, error) {
 		opts = grpc.WithInsecure()
 		ol = append(ol, opts)
 	}
-	ol = append(ol, grpc.WithPerRPCCredentials(c.opts.TokenProvider))
+	if c.opts.TokenProvider != nil {
+		ol = append(ol, grpc.WithPerRPCCredentials(c.opts.TokenProvider))
+	}
 	ol = append(ol, c.opts.GRPCOptions...)
 	//security.CARetryInterceptor())
 
@@ -194,6 +212,6 @@ func (c *CitadelClient) buildConnection() (*grpc.ClientConn, error) {
 }
 
 // GetRootCertBundle: Citadel (Istiod) CA doesn't publish any endpoint to retrieve CA certs
-func (c *CitadelClient) GetRootCertBundle() ([]string, error) {
+func (c *CitadelClient) GetRootCertBundle(ctx context.Context) ([]string, error) {
 	return []string{}, nil
 }
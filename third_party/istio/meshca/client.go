@@ -65,7 +65,7 @@ func NewGoogleCAClient(endpoint string, ol []grpc.DialOption) (*GoogleCAClient,
 }
 
 // CSR Sign calls Google CA to sign a CSR.
-func (cl *GoogleCAClient) CSRSign(csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+func (cl *GoogleCAClient) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
 	req := &MeshCertificateRequest{
 		RequestId: uuid.New().String(),
 		Csr:       string(csrPEM),
@@ -77,7 +77,7 @@ func (cl *GoogleCAClient) CSRSign(csrPEM []byte, certValidTTLInSec int64) ([]str
 		out["x-goog-request-params"] = []string{fmt.Sprintf("location=locations/%s", cl.Location)}
 	}
 
-	ctx := metadata.NewOutgoingContext(context.Background(), out)
+	ctx = metadata.NewOutgoingContext(ctx, out)
 	resp, err := cl.client.CreateCertificate(ctx, req)
 	if err != nil {
 		log.Printf("Failed to create certificate: %v", err)
@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vault is a CA client for the HashiCorp Vault PKI secrets engine.
+//
+// The CSR is signed with the sign endpoint of a PKI role - POST /v1/MOUNT/sign/ROLE. The role
+// should use the CSR SANs and allow the SPIFFE URIs of the workloads, for example:
+//
+//	vault write pki/roles/workload allowed_uri_sans="spiffe://cluster.local/*" require_cn=false \
+//	    allow_any_name=false enforce_hostnames=false max_ttl=24h
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options for the Vault client.
+type Options struct {
+	// Addr is the base URL of the Vault server, like https://vault.example.com:8200.
+	// http:// can be used with a local stand-in, for tests.
+	Addr string
+
+	// Mount is the path of the PKI secrets engine, default "pki".
+	Mount string
+
+	// Role used to sign the workload certs.
+	Role string
+
+	// Token is a Vault token. If empty, JWTSource is used to login.
+	Token string
+
+	// JWTSource returns the JWT used to login with the Kubernetes or JWT auth method - for
+	// example a K8S token with the Vault audience.
+	JWTSource func(ctx context.Context) (string, error)
+
+	// AuthPath is the mount of the auth method, default "auth/kubernetes".
+	AuthPath string
+
+	// AuthRole is the role of the auth method.
+	AuthRole string
+
+	// HTTPClient is used for all requests. Default http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Timeout for each call, including the login. Default 10s.
+	Timeout time.Duration
+}
+
+// Client signs CSRs with Vault PKI.
+type Client struct {
+	opts Options
+
+	m       sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewClient creates a Vault PKI client.
+func NewClient(opts *Options) (*Client, error) {
+	c := &Client{opts: *opts}
+	if c.opts.Addr == "" {
+		return nil, errors.New("missing Vault address")
+	}
+	if c.opts.Role == "" {
+		return nil, errors.New("missing Vault PKI role")
+	}
+	if c.opts.Token == "" && c.opts.JWTSource == nil {
+		return nil, errors.New("missing Vault token or JWT source")
+	}
+	c.opts.Addr = strings.TrimSuffix(c.opts.Addr, "/")
+	if c.opts.Mount == "" {
+		c.opts.Mount = "pki"
+	}
+	if c.opts.AuthPath == "" {
+		c.opts.AuthPath = "auth/kubernetes"
+	}
+	if c.opts.HTTPClient == nil {
+		c.opts.HTTPClient = http.DefaultClient
+	}
+	if c.opts.Timeout == 0 {
+		c.opts.Timeout = 10 * time.Second
+	}
+	return c, nil
+}
+
+type signRequest struct {
+	CSR    string `json:"csr"`
+	TTL    string `json:"ttl,omitempty"`
+	Format string `json:"format"`
+}
+
+type signResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	} `json:"data"`
+}
+
+type loginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+type errorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// CSRSign signs the CSR with the PKI role, returning the chain with the workload cert first.
+func (c *Client) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+	ctx, cf := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cf()
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &signRequest{CSR: string(csrPEM), Format: "pem"}
+	if certValidTTLInSec > 0 {
+		req.TTL = fmt.Sprintf("%ds", certValidTTLInSec)
+	}
+	res := &signResponse{}
+	err = c.do(ctx, "POST", c.opts.Mount+"/sign/"+c.opts.Role, token, req, res)
+	if err != nil {
+		if he, ok := err.(*HTTPError); ok && he.StatusCode == http.StatusForbidden {
+			c.resetToken(token)
+		}
+		return nil, err
+	}
+	if res.Data.Certificate == "" {
+		return nil, errors.New("vault returned an empty certificate")
+	}
+	chain := []string{res.Data.Certificate}
+	if len(res.Data.CAChain) > 0 {
+		chain = append(chain, res.Data.CAChain...)
+	} else if res.Data.IssuingCA != "" {
+		chain = append(chain, res.Data.IssuingCA)
+	}
+	return chain, nil
+}
+
+// GetRootCertBundle returns the CA of the PKI mount - GET /v1/MOUNT/ca/pem, which doesn't
+// require a token.
+func (c *Client) GetRootCertBundle(ctx context.Context) ([]string, error) {
+	ctx, cf := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cf()
+	hreq, err := http.NewRequestWithContext(ctx, "GET", c.opts.Addr+"/v1/"+c.opts.Mount+"/ca/pem", nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.send(hreq)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, errors.New("vault returned an empty CA")
+	}
+	return []string{string(body)}, nil
+}
+
+// getToken returns the static token, or logs in with the JWT, caching the token until 1 minute
+// before the lease expires, or until it is rejected if the lease is 0.
+func (c *Client) getToken(ctx context.Context) (string, error) {
+	if c.opts.Token != "" {
+		return c.opts.Token, nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.token != "" && (c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return c.token, nil
+	}
+	jwt, err := c.opts.JWTSource(ctx)
+	if err != nil {
+		return "", err
+	}
+	res := &loginResponse{}
+	err = c.do(ctx, "POST", c.opts.AuthPath+"/login", "", map[string]string{
+		"role": c.opts.AuthRole,
+		"jwt":  jwt,
+	}, res)
+	if err != nil {
+		return "", fmt.Errorf("vault login: %w", err)
+	}
+	if res.Auth.ClientToken == "" {
+		return "", errors.New("vault login returned an empty token")
+	}
+	c.token = res.Auth.ClientToken
+	// A 0 lease is a token that doesn't expire. Short leases are renewed half way.
+	c.expires = time.Time{}
+	if lease := time.Duration(res.Auth.LeaseDuration) * time.Second; lease > 0 {
+		margin := time.Minute
+		if lease < 2*margin {
+			margin = lease / 2
+		}
+		c.expires = time.Now().Add(lease - margin)
+	}
+	return c.token, nil
+}
+
+// resetToken drops the cached login token, if it was rejected - for example revoked.
+func (c *Client) resetToken(token string) {
+	c.m.Lock()
+	if c.token == token {
+		c.token = ""
+	}
+	c.m.Unlock()
+}
+
+// do sends a JSON request to /v1/PATH and decodes the JSON response.
+func (c *Client) do(ctx context.Context, method, path, token string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, method, c.opts.Addr+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		hreq.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := c.send(hreq)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp, out)
+}
+
+func (c *Client) send(hreq *http.Request) ([]byte, error) {
+	res, err := c.opts.HTTPClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		he := &HTTPError{Path: hreq.URL.Path, StatusCode: res.StatusCode}
+		er := &errorResponse{}
+		if json.Unmarshal(body, er) == nil {
+			he.Errors = er.Errors
+		}
+		return nil, he
+	}
+	return body, nil
+}
+
+// HTTPError is returned when Vault responds with an error status.
+type HTTPError struct {
+	Path       string
+	StatusCode int
+	Errors     []string
+}
+
+func (e *HTTPError) Error() string {
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("vault %s: %d %s", e.Path, e.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	return fmt.Sprintf("vault %s: %d", e.Path, e.StatusCode)
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeVault is a Vault stand-in with the kubernetes auth method and a PKI mount at pki/int.
+type fakeVault struct {
+	*httptest.Server
+
+	logins int32
+	// lease is the lease_duration of the login token.
+	lease int
+	// token is the token accepted by the sign endpoint.
+	token string
+	sign  map[string]string
+	// resp is the sign response.
+	resp string
+}
+
+func newFakeVault() *fakeVault {
+	fv := &fakeVault{lease: 3600, token: "s.tok", resp: `{"data":{"certificate":"LEAF","issuing_ca":"INT","ca_chain":["INT","ROOT"]}}`}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fv.logins, 1)
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["role"] != "default" || req["jwt"] != "jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["invalid role or jwt"]}`))
+			return
+		}
+		fmt.Fprintf(w, `{"auth":{"client_token":"s.tok","lease_duration":%d}}`, fv.lease)
+	})
+	mux.HandleFunc("/v1/pki/int/sign/workload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("X-Vault-Token") != fv.token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		fv.sign = map[string]string{}
+		json.NewDecoder(r.Body).Decode(&fv.sign)
+		w.Write([]byte(fv.resp))
+	})
+	mux.HandleFunc("/v1/pki/int/ca/pem", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ROOT\n"))
+	})
+	mux.HandleFunc("/v1/slow/ca/pem", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	fv.Server = httptest.NewServer(mux)
+	return fv
+}
+
+func TestNewClient(t *testing.T) {
+	jwt := func(ctx context.Context) (string, error) { return "jwt", nil }
+	for _, o := range []*Options{
+		{Role: "workload", Token: "t"},
+		{Addr: "http://vault", Token: "t"},
+		{Addr: "http://vault", Role: "workload"},
+	} {
+		if _, err := NewClient(o); err == nil {
+			t.Errorf("%+v: expecting error", o)
+		}
+	}
+	c, err := NewClient(&Options{Addr: "http://vault/", Role: "workload", JWTSource: jwt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.opts.Addr != "http://vault" || c.opts.Mount != "pki" || c.opts.AuthPath != "auth/kubernetes" ||
+		c.opts.HTTPClient != http.DefaultClient || c.opts.Timeout != 10*time.Second {
+		t.Errorf("unexpected defaults %+v", c.opts)
+	}
+}
+
+func TestCSRSign(t *testing.T) {
+	fv := newFakeVault()
+	defer fv.Close()
+	ctx := context.Background()
+
+	c, _ := NewClient(&Options{Addr: fv.URL + "/", Mount: "pki/int", Role: "workload", AuthRole: "default",
+		JWTSource: func(ctx context.Context) (string, error) { return "jwt", nil }})
+
+	for i := 0; i < 2; i++ {
+		chain, err := c.CSRSign(ctx, []byte("CSR"), 3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chain, []string{"LEAF", "INT", "ROOT"}) {
+			t.Errorf("unexpected chain %v", chain)
+		}
+	}
+	if !reflect.DeepEqual(fv.sign, map[string]string{"csr": "CSR", "ttl": "3600s", "format": "pem"}) {
+		t.Errorf("unexpected sign request %v", fv.sign)
+	}
+	if n := atomic.LoadInt32(&fv.logins); n != 1 {
+		t.Errorf("token not cached, %d logins", n)
+	}
+
+	// Login again when the lease is about to expire.
+	c.expires = time.Now().Add(-time.Second)
+	if _, err := c.CSRSign(ctx, []byte("CSR"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fv.logins); n != 2 {
+		t.Errorf("expired token reused, %d logins", n)
+	}
+	if _, f := fv.sign["ttl"]; f {
+		t.Error("ttl sent without a requested TTL")
+	}
+
+	// Without ca_chain, the issuing CA is used.
+	fv.resp = `{"data":{"certificate":"LEAF","issuing_ca":"INT"}}`
+	if chain, _ := c.CSRSign(ctx, []byte("CSR"), 0); !reflect.DeepEqual(chain, []string{"LEAF", "INT"}) {
+		t.Errorf("unexpected chain %v", chain)
+	}
+	fv.resp = `{"data":{}}`
+	if _, err := c.CSRSign(ctx, []byte("CSR"), 0); err == nil {
+		t.Error("expecting error for an empty certificate")
+	}
+}
+
+func TestTokenLease(t *testing.T) {
+	fv := newFakeVault()
+	defer fv.Close()
+	ctx := context.Background()
+	c, _ := NewClient(&Options{Addr: fv.URL, Mount: "pki/int", Role: "workload", AuthRole: "default",
+		JWTSource: func(ctx context.Context) (string, error) { return "jwt", nil }})
+
+	// A 0 lease doesn't expire.
+	fv.lease = 0
+	for i := 0; i < 3; i++ {
+		if _, err := c.CSRSign(ctx, []byte("CSR"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&fv.logins); n != 1 {
+		t.Errorf("non-expiring token not cached, %d logins", n)
+	}
+
+	// A rejected token is dropped, the next call logs in again.
+	fv.token = "s.other"
+	if _, err := c.CSRSign(ctx, []byte("CSR"), 0); err == nil {
+		t.Fatal("expecting permission denied")
+	}
+	fv.token = "s.tok"
+	if _, err := c.CSRSign(ctx, []byte("CSR"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fv.logins); n != 2 {
+		t.Errorf("rejected token reused, %d logins", n)
+	}
+
+	// Short leases are renewed half way.
+	fv.lease = 30
+	c.resetToken("s.tok")
+	c.getToken(ctx)
+	if d := time.Until(c.expires); d <= 10*time.Second || d > 15*time.Second {
+		t.Errorf("unexpected expiration for a 30s lease %v", d)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fv := newFakeVault()
+	defer fv.Close()
+	ctx := context.Background()
+
+	c, _ := NewClient(&Options{Addr: fv.URL, Mount: "pki/int", Role: "workload", Token: "bad"})
+	_, err := c.CSRSign(ctx, []byte("CSR"), 0)
+	if err == nil || !strings.Contains(err.Error(), "403 permission denied") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if he, ok := err.(*HTTPError); !ok || he.StatusCode != http.StatusForbidden {
+		t.Errorf("expecting HTTPError, got %#v", err)
+	}
+
+	c, _ = NewClient(&Options{Addr: fv.URL, Mount: "pki/int", Role: "workload", AuthRole: "other",
+		JWTSource: func(ctx context.Context) (string, error) { return "jwt", nil }})
+	_, err = c.CSRSign(ctx, []byte("CSR"), 0)
+	if err == nil || !strings.Contains(err.Error(), "vault login") {
+		t.Errorf("unexpected login error %v", err)
+	}
+}
+
+func TestGetRootCertBundle(t *testing.T) {
+	fv := newFakeVault()
+	defer fv.Close()
+
+	c, _ := NewClient(&Options{Addr: fv.URL, Mount: "pki/int", Role: "workload", Token: "t"})
+	roots, err := c.GetRootCertBundle(context.Background())
+	if err != nil || !reflect.DeepEqual(roots, []string{"ROOT\n"}) {
+		t.Errorf("got %v %v", roots, err)
+	}
+
+	c, _ = NewClient(&Options{Addr: fv.URL, Mount: "missing", Role: "workload", Token: "t"})
+	if _, err := c.GetRootCertBundle(context.Background()); err == nil {
+		t.Error("expecting error for a missing mount")
+	}
+
+	// Calls are bounded by the timeout.
+	c, _ = NewClient(&Options{Addr: fv.URL, Mount: "slow", Role: "workload", Token: "t", Timeout: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err := c.GetRootCertBundle(context.Background()); err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("timeout not applied: %v after %v", err, time.Since(start))
+	}
+}
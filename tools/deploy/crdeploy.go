@@ -10,7 +10,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"strings"
 	"time"
@@ -18,6 +17,8 @@ import (
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	runapi "google.golang.org/api/run/v1"
+
+	"github.com/costinm/krun/pkg/logs"
 )
 
 // parseEnv parses K=V pairs into a map.
@@ -43,6 +44,8 @@ func getService(project, name, region string) (*runapi.Service, error) {
 	return client.Namespaces.Services.Get(fmt.Sprintf("namespaces/%s/services/%s", project, name)).Do()
 }
 
+var logger = logs.New("crdeploy")
+
 type options struct {
 	AllowUnauthenticated *bool  `json:"allow-unauthenticated"`
 	Memory               string `json:"memory"`
@@ -55,10 +58,9 @@ func main() {
 	k, err := deploy("wlhe-cr", "asm-test", "gcr.io/wlhe-cr/fortio:latest", "us-central1", []string{},
 		options{})
 	if err != nil {
-		log.Println(err)
-		return
+		logger.Fatal("Deploy failed", "error", err)
 	}
-	log.Println(k)
+	logger.Info("Deployed", "url", k)
 }
 
 // deploy reimplements the "gcloud run deploy" command, including setting IAM policy and